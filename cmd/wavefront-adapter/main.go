@@ -4,7 +4,10 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"net"
 	"net/url"
 	"os"
 	"runtime"
@@ -12,16 +15,24 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
-	"k8s.io/apimachinery/pkg/util/wait"
+	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/component-base/logs"
+	"k8s.io/metrics/pkg/apis/metrics/install"
 
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
 	basecmd "sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
 	customprovider "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
 	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/keda/externalscaler"
 	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/provider"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/resourcemetrics"
 )
 
 var (
@@ -36,6 +47,8 @@ type WavefrontAdapter struct {
 	Message string
 	// MetricsRelistInterval is the interval at which list of metrics are fetched from Wavefront
 	MetricsRelistInterval time.Duration
+	// MetricsRemovalThreshold is the number of consecutive lists a custom metric must be missing from before it is removed
+	MetricsRemovalThreshold int
 	// Wavefront client timeout
 	APIClientTimeout time.Duration
 	// Wavefront Server URL of the form https://INSTANCE.wavefront.com
@@ -46,11 +59,34 @@ type WavefrontAdapter struct {
 	CustomMetricPrefix string
 	// The file containing the metrics discovery configuration
 	AdapterConfigFile string
+	// The config map containing the metrics discovery configuration, of the form namespace/name[/key]
+	AdapterConfigMap string
+	// Whether an invalid external metrics configuration is fatal on startup
+	FailOnInvalidConfig bool
+	// Whether to source external metrics from WavefrontExternalMetric objects
+	WatchExternalMetricCRDs bool
+	// The name of the cluster, substituted for ${cluster} within external metric queries
+	ClusterName string
+	// The kinds whose annotations declare external metrics
+	AnnotatedKinds []string
+	// Whether to serve the validating admission webhook for HPAs
+	EnableAdmissionWebhook bool
+	// Whether to serve the resource metrics API in place of the metrics-server
+	EnableResourceMetrics bool
+	// The address the KEDA external scaler gRPC server listens on, disabled when empty
+	KedaScalerAddress string
+	// The serving certificate and key of the KEDA external scaler
+	KedaTLSCertFile string
+	KedaTLSKeyFile  string
+	// The CA verifying the client certificates of the KEDA external scaler
+	KedaTLSCAFile string
+	// Whether KEDA triggers may declare inline queries instead of referring to rules
+	KedaAllowQueries bool
 	// The log level
 	LogLevel string
 }
 
-func (a *WavefrontAdapter) makeProviderOrDie() customprovider.MetricsProvider {
+func (a *WavefrontAdapter) makeProviderOrDie(stopCh <-chan struct{}) (customprovider.MetricsProvider, provider.MetricsLister) {
 	conf, err := a.ClientConfig()
 	if err != nil {
 		log.Fatalf("error getting kube config: %v", err)
@@ -65,6 +101,11 @@ func (a *WavefrontAdapter) makeProviderOrDie() customprovider.MetricsProvider {
 		log.Fatalf("unable to construct dynamic client: %v", err)
 	}
 
+	metadataClient, err := metadata.NewForConfig(conf)
+	if err != nil {
+		log.Fatalf("unable to construct metadata client: %v", err)
+	}
+
 	mapper, err := a.RESTMapper()
 	if err != nil {
 		log.Fatalf("unable to construct discovery REST mapper: %v", err)
@@ -76,17 +117,142 @@ func (a *WavefrontAdapter) makeProviderOrDie() customprovider.MetricsProvider {
 	}
 	waveClient := client.NewWavefrontClient(waveURL, a.WavefrontAPIToken, a.APIClientTimeout)
 
-	metricsProvider, runnable := provider.NewWavefrontProvider(provider.WavefrontProviderConfig{
-		DynClient:    dynClient,
-		KubeClient:   kubeClient,
-		Mapper:       mapper,
-		WaveClient:   waveClient,
-		Prefix:       strings.Trim(a.CustomMetricPrefix, "."),
-		ListInterval: a.MetricsRelistInterval,
-		ExternalCfg:  a.AdapterConfigFile,
+	metricsProvider, lister := provider.NewWavefrontProvider(provider.WavefrontProviderConfig{
+		DynClient:      dynClient,
+		KubeClient:     kubeClient,
+		MetadataClient: metadataClient,
+		Mapper:         mapper,
+		WaveClient:     waveClient,
+		Prefix:         strings.Trim(a.CustomMetricPrefix, "."),
+		ListInterval:   a.MetricsRelistInterval,
+		ExternalCfg:    a.AdapterConfigFile,
+
+		RemovalThreshold:         a.MetricsRemovalThreshold,
+		ExternalCfgMap:           a.AdapterConfigMap,
+		FailOnInvalidExternalCfg: a.FailOnInvalidConfig,
+		WatchExternalMetricCRDs:  a.WatchExternalMetricCRDs,
+		ClusterName:              a.ClusterName,
+		AnnotatedKinds:           a.AnnotatedKinds,
+		StopCh:                   stopCh,
 	})
-	runnable.RunUntil(wait.NeverStop)
-	return metricsProvider
+	return metricsProvider, lister
+}
+
+func (a *WavefrontAdapter) installAdmissionWebhookOrDie(metricsProvider customprovider.MetricsProvider) {
+	admissionProvider, ok := metricsProvider.(provider.AdmissionProvider)
+	if !ok {
+		log.Fatal("the metrics provider does not support admission")
+	}
+	// the API server calls webhooks anonymously
+	a.Authorization.AlwaysAllowPaths = append(a.Authorization.AlwaysAllowPaths, provider.AdmissionWebhookPath)
+	server, err := a.Server()
+	if err != nil {
+		log.Fatalf("unable to construct custom metrics adapter: %v", err)
+	}
+	server.GenericAPIServer.Handler.NonGoRestfulMux.Handle(provider.AdmissionWebhookPath, admissionProvider.AdmissionHandler())
+	log.Infof("serving HPA admission webhook on %s", provider.AdmissionWebhookPath)
+}
+
+func (a *WavefrontAdapter) installResourceMetricsOrDie(metricsProvider customprovider.MetricsProvider) {
+	resourceProvider, ok := metricsProvider.(provider.ResourceMetricsProvider)
+	if !ok {
+		log.Fatal("the metrics provider does not support resource metrics")
+	}
+	// the adapter server encodes responses with the scheme of the custom metrics API server
+	install.Install(apiserver.Scheme)
+	server, err := a.Server()
+	if err != nil {
+		log.Fatalf("unable to construct custom metrics adapter: %v", err)
+	}
+	if err := resourcemetrics.Install(server.GenericAPIServer, resourceProvider); err != nil {
+		log.Fatalf("unable to install resource metrics API: %v", err)
+	}
+	log.Info("serving resource metrics API")
+}
+
+// runKedaScalerOrDie serves the KEDA external scaler on the given address until stopCh is closed.
+func (a *WavefrontAdapter) runKedaScalerOrDie(metricsProvider customprovider.MetricsProvider, stopCh <-chan struct{}) {
+	scalerProvider, ok := metricsProvider.(provider.ExternalScalerProvider)
+	if !ok {
+		log.Fatal("the metrics provider does not support KEDA external scalers")
+	}
+	listener, err := net.Listen("tcp", a.KedaScalerAddress)
+	if err != nil {
+		log.Fatalf("unable to listen for KEDA external scaler: %v", err)
+	}
+	server := grpc.NewServer(a.kedaServerOptionsOrDie()...)
+	externalscaler.RegisterExternalScalerServer(server, scalerProvider.ExternalScaler(a.KedaAllowQueries))
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Fatalf("unable to serve KEDA external scaler: %v", err)
+		}
+	}()
+	go func() {
+		<-stopCh
+		// streams only end once their context is cancelled, so a graceful stop would never return
+		server.Stop()
+	}()
+	log.Infof("serving KEDA external scaler on %s", listener.Addr())
+}
+
+// kedaServerOptionsOrDie returns the options serving the KEDA external scaler over TLS,
+// requiring client certificates signed by the configured CA.
+func (a *WavefrontAdapter) kedaServerOptionsOrDie() []grpc.ServerOption {
+	if a.KedaTLSCertFile == "" && a.KedaTLSKeyFile == "" && a.KedaTLSCAFile == "" {
+		log.Warning("serving KEDA external scaler without TLS, any client able to reach it can evaluate the external metric rules")
+		return nil
+	}
+	if a.KedaTLSCertFile == "" || a.KedaTLSKeyFile == "" || a.KedaTLSCAFile == "" {
+		log.Fatal("--keda-tls-cert-file, --keda-tls-key-file and --keda-tls-ca-file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(a.KedaTLSCertFile, a.KedaTLSKeyFile)
+	if err != nil {
+		log.Fatalf("unable to load KEDA external scaler certificate: %v", err)
+	}
+	ca, err := os.ReadFile(a.KedaTLSCAFile)
+	if err != nil {
+		log.Fatalf("unable to read KEDA external scaler client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(ca) {
+		log.Fatalf("no certificates found in KEDA external scaler client CA %s", a.KedaTLSCAFile)
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}))}
+}
+
+// runListerOrDie refreshes the list of metrics once the server has started and until it shuts down.
+func (a *WavefrontAdapter) runListerOrDie(lister provider.MetricsLister) {
+	server, err := a.Server()
+	if err != nil {
+		log.Fatalf("unable to construct custom metrics adapter: %v", err)
+	}
+	server.GenericAPIServer.AddPostStartHookOrDie("wavefront-metrics-lister", func(ctx genericapiserver.PostStartHookContext) error {
+		lister.RunUntil(ctx.StopCh)
+		return nil
+	})
+}
+
+// installHealthChecksOrDie adds the readiness and liveness checks of the provider to /readyz and /livez.
+func (a *WavefrontAdapter) installHealthChecksOrDie(metricsProvider customprovider.MetricsProvider) {
+	healthProvider, ok := metricsProvider.(provider.HealthProvider)
+	if !ok {
+		return
+	}
+	server, err := a.Server()
+	if err != nil {
+		log.Fatalf("unable to construct custom metrics adapter: %v", err)
+	}
+	if err := server.GenericAPIServer.AddReadyzChecks(healthProvider.ReadyzChecks()...); err != nil {
+		log.Fatalf("unable to add readiness checks: %v", err)
+	}
+	if err := server.GenericAPIServer.AddLivezChecks(0, healthProvider.LivezChecks()...); err != nil {
+		log.Fatalf("unable to add liveness checks: %v", err)
+	}
 }
 
 func main() {
@@ -94,6 +260,18 @@ func main() {
 	log.SetLevel(log.InfoLevel)
 	log.SetOutput(os.Stdout)
 
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		// keep stdout clean for the query output
+		log.SetOutput(os.Stderr)
+		if err := runQuery(os.Args[2:], os.Stdout); err != nil {
+			if err != pflag.ErrHelp {
+				log.Errorf("query failed: %v", err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+
 	logs.InitLogs()
 	defer logs.FlushLogs()
 
@@ -102,14 +280,17 @@ func main() {
 	}
 
 	cmd := &WavefrontAdapter{
-		CustomMetricPrefix:    "kubernetes",
-		MetricsRelistInterval: 10 * time.Minute,
-		APIClientTimeout:      10 * time.Second,
+		CustomMetricPrefix:      "kubernetes",
+		MetricsRelistInterval:   10 * time.Minute,
+		APIClientTimeout:        10 * time.Second,
+		MetricsRemovalThreshold: 3,
 	}
 	cmd.Name = "wavefront-custom-metrics-adapter"
 	flags := cmd.Flags()
 	flags.DurationVar(&cmd.MetricsRelistInterval, "metrics-relist-interval", cmd.MetricsRelistInterval, ""+
 		"Interval at which to fetch the list of custom metric names from Operations for Applications.")
+	flags.IntVar(&cmd.MetricsRemovalThreshold, "metrics-removal-threshold", cmd.MetricsRemovalThreshold, ""+
+		"Number of consecutive successful lists a custom metric must be missing from before it is removed.")
 	flags.DurationVar(&cmd.APIClientTimeout, "api-client-timeout", cmd.APIClientTimeout, ""+
 		"Client timeout to Operations for Applications.")
 	flags.StringVar(&cmd.WavefrontServerURL, "wavefront-url", "",
@@ -120,6 +301,30 @@ func main() {
 		"Metrics under this prefix are exposed in the custom metrics API.")
 	flags.StringVar(&cmd.AdapterConfigFile, "external-metrics-config", "",
 		"Configuration file for driving external metrics API.")
+	flags.StringVar(&cmd.AdapterConfigMap, "external-metrics-configmap", "",
+		"Config map for driving external metrics API, of the form namespace/name[/key]. The key defaults to config.yaml. Changes are applied immediately.")
+	flags.BoolVar(&cmd.FailOnInvalidConfig, "fail-on-invalid-external-config", false,
+		"Exit on startup if the external metrics config file or config map is missing or invalid. Later errors never exit, and invalid rules from annotations or WavefrontExternalMetric objects are only reported and skipped.")
+	flags.BoolVar(&cmd.WatchExternalMetricCRDs, "watch-external-metric-crds", false,
+		"Source external metrics from WavefrontExternalMetric objects. Requires the WavefrontExternalMetric CRD to be installed.")
+	flags.StringVar(&cmd.ClusterName, "cluster-name", "",
+		"Name of the cluster, substituted for ${cluster} within external metric queries.")
+	flags.StringSliceVar(&cmd.AnnotatedKinds, "annotated-kinds", []string{"HorizontalPodAutoscaler"},
+		"Kinds whose wavefront.com.external.metric annotations declare external metrics, any of "+strings.Join(provider.AnnotatedKinds(), ", ")+".")
+	flags.BoolVar(&cmd.EnableAdmissionWebhook, "enable-admission-webhook", false,
+		"Serve a validating admission webhook for HPAs on "+provider.AdmissionWebhookPath+". Requires a ValidatingWebhookConfiguration.")
+	flags.BoolVar(&cmd.EnableResourceMetrics, "enable-resource-metrics", false,
+		"Serve pod and node CPU and memory usage as metrics.k8s.io in place of the metrics-server. Requires the v1beta1.metrics.k8s.io APIService.")
+	flags.StringVar(&cmd.KedaScalerAddress, "keda-scaler-address", "",
+		"Address of the KEDA external scaler gRPC server, such as :6000. Disabled when empty.")
+	flags.StringVar(&cmd.KedaTLSCertFile, "keda-tls-cert-file", "",
+		"Serving certificate of the KEDA external scaler. Requires --keda-tls-key-file and --keda-tls-ca-file.")
+	flags.StringVar(&cmd.KedaTLSKeyFile, "keda-tls-key-file", "",
+		"Private key of the serving certificate of the KEDA external scaler.")
+	flags.StringVar(&cmd.KedaTLSCAFile, "keda-tls-ca-file", "",
+		"CA bundle verifying the client certificates required by the KEDA external scaler.")
+	flags.BoolVar(&cmd.KedaAllowQueries, "keda-allow-queries", false,
+		"Allow KEDA triggers to declare a query instead of referring to an external metric rule. Any client of the scaler can then run arbitrary queries.")
 	flags.StringVar(&cmd.LogLevel, "log-level", "info", "One of info, debug or trace.")
 	flags.StringVar(&cmd.Message, "msg", "starting wavefront adapter", "startup message")
 	flags.AddGoFlagSet(flag.CommandLine) // make sure we get the glog flags
@@ -134,12 +339,30 @@ func main() {
 		log.SetLevel(log.WarnLevel)
 	}
 
-	wavefrontProvider := cmd.makeProviderOrDie()
+	if cmd.AdapterConfigFile != "" && cmd.AdapterConfigMap != "" {
+		log.Fatal("only one of --external-metrics-config and --external-metrics-configmap can be specified")
+	}
+
+	// closed on SIGTERM or SIGINT, stops the server and all background discovery
+	stopCh := genericapiserver.SetupSignalHandler()
+
+	wavefrontProvider, lister := cmd.makeProviderOrDie(stopCh)
 	cmd.WithCustomMetrics(wavefrontProvider)
 	cmd.WithExternalMetrics(wavefrontProvider)
+	if cmd.EnableAdmissionWebhook {
+		cmd.installAdmissionWebhookOrDie(wavefrontProvider)
+	}
+	if cmd.EnableResourceMetrics {
+		cmd.installResourceMetricsOrDie(wavefrontProvider)
+	}
+	if cmd.KedaScalerAddress != "" {
+		cmd.runKedaScalerOrDie(wavefrontProvider, stopCh)
+	}
+	cmd.runListerOrDie(lister)
+	cmd.installHealthChecksOrDie(wavefrontProvider)
 
 	log.Infof("%s version: %s commit tip: %s", cmd.Message, version, commit)
-	if err := cmd.Run(wait.NeverStop); err != nil {
+	if err := cmd.Run(stopCh); err != nil {
 		log.Fatalf("unable to run custom metrics adapter: %v", err)
 	}
 }
@@ -0,0 +1,294 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+
+	customprovider "sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/provider"
+)
+
+const queryUsage = `Evaluates a metric the way the adapter would serve it.
+
+Usage:
+  wavefront-adapter query --external <metric> [flags]
+  wavefront-adapter query --custom <resource>/<metric> --namespace <namespace> [--selector <selector>] [flags]
+
+Flags:
+`
+
+// QueryCommand evaluates a single custom or external metric and prints each step of the evaluation.
+type QueryCommand struct {
+	// Wavefront Server URL of the form https://INSTANCE.wavefront.com
+	WavefrontServerURL string
+	// Wavefront API token with permissions to query points
+	WavefrontAPIToken string
+	// Wavefront client timeout
+	APIClientTimeout time.Duration
+	// The prefix for custom kubernetes metrics in Wavefront
+	CustomMetricPrefix string
+	// The file containing the external metrics configuration
+	AdapterConfigFile string
+	// The name of the cluster, substituted for ${cluster} within external metric queries
+	ClusterName string
+	// The kubeconfig file used to resolve selectors and HPA annotations
+	KubeConfigFile string
+	// The external metric to evaluate
+	ExternalMetric string
+	// The custom metric to evaluate, in the form <resource>/<metric>
+	CustomMetric string
+	// An explicit ts query for the external metric, bypassing rule lookup
+	Query string
+	// The namespace of the request
+	Namespace string
+	// The label selector of the request
+	Selector string
+	// One of text or json
+	Output string
+}
+
+func runQuery(args []string, out io.Writer) error {
+	cmd := &QueryCommand{
+		CustomMetricPrefix: "kubernetes",
+		APIClientTimeout:   10 * time.Second,
+		Namespace:          v1.NamespaceDefault,
+		Output:             "text",
+	}
+	flags := pflag.NewFlagSet("query", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, queryUsage)
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&cmd.WavefrontServerURL, "wavefront-url", "",
+		"Wavefront URL in the format https://YOUR_INSTANCE.wavefront.com. Any Wavefront compatible base URL can be used.")
+	flags.StringVar(&cmd.WavefrontAPIToken, "wavefront-token", os.Getenv("WAVEFRONT_TOKEN"),
+		"Wavefront API token with permissions to query for points. Defaults to $WAVEFRONT_TOKEN.")
+	flags.DurationVar(&cmd.APIClientTimeout, "api-client-timeout", cmd.APIClientTimeout,
+		"Client timeout to Operations for Applications.")
+	flags.StringVar(&cmd.CustomMetricPrefix, "wavefront-metric-prefix", cmd.CustomMetricPrefix,
+		"Metrics under this prefix are exposed in the custom metrics API.")
+	flags.StringVar(&cmd.AdapterConfigFile, "external-metrics-config", "",
+		"Configuration file for driving external metrics API.")
+	flags.StringVar(&cmd.ClusterName, "cluster-name", "",
+		"Name of the cluster, substituted for ${cluster} within external metric queries.")
+	flags.StringVar(&cmd.KubeConfigFile, "kubeconfig", "",
+		"Kubeconfig file used to resolve selectors and HPA annotations. Defaults to the standard kubeconfig loading rules.")
+	flags.StringVar(&cmd.ExternalMetric, "external", "", "The external metric to evaluate.")
+	flags.StringVar(&cmd.CustomMetric, "custom", "", "The custom metric to evaluate, in the form <resource>/<metric>.")
+	flags.StringVar(&cmd.Query, "query", "", "An explicit ts query for the external metric, instead of looking up its rule.")
+	flags.StringVarP(&cmd.Namespace, "namespace", "n", cmd.Namespace, "The namespace of the request.")
+	flags.StringVarP(&cmd.Selector, "selector", "l", "", "The label selector of the request.")
+	flags.StringVarP(&cmd.Output, "output", "o", cmd.Output, "One of text or json.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return cmd.Run(out)
+}
+
+// Run evaluates the requested metric and writes the explanation to out.
+func (c *QueryCommand) Run(out io.Writer) error {
+	if (c.ExternalMetric == "") == (c.CustomMetric == "") {
+		return fmt.Errorf("exactly one of --external or --custom must be specified")
+	}
+	if c.WavefrontServerURL == "" {
+		return fmt.Errorf("--wavefront-url must be specified")
+	}
+	waveURL, err := url.Parse(c.WavefrontServerURL)
+	if err != nil {
+		return fmt.Errorf("unable to parse wavefront url: %v", err)
+	}
+	selector, err := labels.Parse(c.Selector)
+	if err != nil {
+		return fmt.Errorf("unable to parse selector: %v", err)
+	}
+
+	cfg := provider.WavefrontProviderConfig{
+		WaveClient:  client.NewWavefrontClient(waveURL, c.WavefrontAPIToken, c.APIClientTimeout),
+		Prefix:      strings.Trim(c.CustomMetricPrefix, "."),
+		ClusterName: c.ClusterName,
+	}
+
+	var explanation *provider.QueryExplanation
+	if c.CustomMetric != "" {
+		explanation, err = c.explainCustom(cfg, selector)
+	} else {
+		explanation, err = c.explainExternal(cfg, selector)
+	}
+	if explanation != nil {
+		if printErr := c.print(out, explanation); printErr != nil {
+			return printErr
+		}
+	}
+	return err
+}
+
+func (c *QueryCommand) explainCustom(cfg provider.WavefrontProviderConfig, selector labels.Selector) (*provider.QueryExplanation, error) {
+	parts := strings.SplitN(c.CustomMetric, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid custom metric %q, expected <resource>/<metric>", c.CustomMetric)
+	}
+
+	loader := c.kubeConfigLoader()
+	restConfig, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("custom metrics require access to a cluster: %v", err)
+	}
+	cfg.DynClient, err = dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct dynamic client: %v", err)
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct discovery client: %v", err)
+	}
+	cfg.Mapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+
+	// custom metrics are filtered, renamed and converted as configured for the adapter
+	var customMetrics *config.CustomMetricsConfig
+	if c.AdapterConfigFile != "" {
+		metricsConfig, err := config.FromFile(c.AdapterConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		customMetrics = metricsConfig.CustomMetrics
+	}
+
+	info := provider.CustomMetricInfoFor(parts[0], parts[1])
+	return provider.NewQueryExplainer(cfg, nil, nil, customMetrics).ExplainCustomMetric(c.Namespace, selector, info)
+}
+
+func (c *QueryCommand) explainExternal(cfg provider.WavefrontProviderConfig, selector labels.Selector) (*provider.QueryExplanation, error) {
+	rules, patterns, kubeClient, err := c.externalRules()
+	if err != nil {
+		return nil, err
+	}
+	// namespace selectors of rules are checked against the cluster as the adapter would
+	cfg.KubeClient = kubeClient
+	info := customprovider.ExternalMetricInfo{Metric: c.ExternalMetric}
+	return provider.NewQueryExplainer(cfg, rules, patterns, nil).ExplainExternalMetric(c.Namespace, selector, info)
+}
+
+// externalRules collects the rules the adapter would know about, keyed by namespace:
+// cluster-wide rules and patterns from the configuration file and rules from HPA annotations in the request namespace.
+// The kube client is nil without cluster access.
+func (c *QueryCommand) externalRules() (map[string][]config.MetricRule, []config.PatternRule, kubernetes.Interface, error) {
+	if c.Query != "" {
+		return map[string][]config.MetricRule{"": {{Name: c.ExternalMetric, Query: c.Query}}}, nil, nil, nil
+	}
+
+	rules := make(map[string][]config.MetricRule)
+	var patterns []config.PatternRule
+	if c.AdapterConfigFile != "" {
+		metricsConfig, err := config.FromFile(c.AdapterConfigFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rules[""] = metricsConfig.Rules
+		patterns = metricsConfig.Patterns
+	}
+
+	restConfig, err := c.kubeConfigLoader().ClientConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skipping HPA annotations and namespace selectors, no cluster access: %v\n", err)
+		return rules, patterns, nil, nil
+	}
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating kube client: %v", err)
+	}
+	hpaRules, err := provider.RulesFromHPAs(kubeClient, c.Namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skipping HPA annotations, unable to list HPAs: %v\n", err)
+		return rules, patterns, kubeClient, nil
+	}
+	rules[c.Namespace] = hpaRules[c.Namespace]
+	return rules, patterns, kubeClient, nil
+}
+
+func (c *QueryCommand) kubeConfigLoader() clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if c.KubeConfigFile != "" {
+		loadingRules.ExplicitPath = c.KubeConfigFile
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+}
+
+func (c *QueryCommand) print(out io.Writer, explanation *provider.QueryExplanation) error {
+	switch c.Output {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanation)
+	case "text":
+	default:
+		return fmt.Errorf("unsupported output format: %s", c.Output)
+	}
+
+	fmt.Fprintf(out, "metric:    %s\n", explanation.Metric)
+	fmt.Fprintf(out, "namespace: %s\n", explanation.Namespace)
+	if len(explanation.Names) > 0 {
+		fmt.Fprintf(out, "names:     %s\n", strings.Join(explanation.Names, ", "))
+	}
+	fmt.Fprintf(out, "query:     %s\n", explanation.Query)
+
+	if len(explanation.Operands) == 0 {
+		printSeries(out, "series", explanation.Result)
+	}
+	for _, operand := range explanation.Operands {
+		fmt.Fprintf(out, "\noperand %s: %s\n", operand.Name, operand.Query)
+		printSeries(out, "series of "+operand.Name, operand.Result)
+	}
+
+	matched := make([]string, 0, len(explanation.Matched))
+	for name := range explanation.Matched {
+		matched = append(matched, name)
+	}
+	sort.Strings(matched)
+	fmt.Fprintf(out, "\nmatched (%d):\n", len(matched))
+	for _, name := range matched {
+		fmt.Fprintf(out, "  %s: %v\n", name, explanation.Matched[name])
+	}
+
+	fmt.Fprintf(out, "\nserved (%d):\n", len(explanation.Served))
+	for _, value := range explanation.Served {
+		if len(value.Labels) > 0 {
+			fmt.Fprintf(out, "  %s%v: %s\n", value.Name, value.Labels, value.Quantity)
+		} else {
+			fmt.Fprintf(out, "  %s: %s\n", value.Name, value.Quantity)
+		}
+	}
+	return nil
+}
+
+func printSeries(out io.Writer, title string, result client.QueryResult) {
+	fmt.Fprintf(out, "\n%s (%d):\n", title, len(result.Timeseries))
+	for _, timeseries := range result.Timeseries {
+		fmt.Fprintf(out, "  label=%s host=%s tags=%v\n", timeseries.Label, timeseries.Host, timeseries.Tags)
+		for _, point := range timeseries.Data {
+			fmt.Fprintf(out, "    %v\n", point)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package v1alpha1 contains the wavefront.com/v1alpha1 API types.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	GroupName                    = "wavefront.com"
+	Version                      = "v1alpha1"
+	WavefrontExternalMetricKind  = "WavefrontExternalMetric"
+	WavefrontExternalMetricsName = "wavefrontexternalmetrics"
+)
+
+var (
+	SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: Version}
+
+	WavefrontExternalMetricResource = SchemeGroupVersion.WithResource(WavefrontExternalMetricsName)
+)
+
+// WavefrontExternalMetric exposes a Wavefront query through the external metrics API
+// to the namespace it is created in.
+type WavefrontExternalMetric struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WavefrontExternalMetricSpec   `json:"spec"`
+	Status WavefrontExternalMetricStatus `json:"status,omitempty"`
+}
+
+type WavefrontExternalMetricSpec struct {
+	// MetricName is the name of the external metric, defaults to the name of the object
+	MetricName string `json:"metricName,omitempty"`
+
+	// Query specifies a Wavefront ts query
+	Query string `json:"query"`
+
+	// Window specifies how far back to query for points, 30s if not set
+	Window *metav1.Duration `json:"window,omitempty"`
+
+	// Reduction specifies how the points within the window are reduced to a single value.
+	// One of last, avg, min, max or sum, defaults to last.
+	Reduction string `json:"reduction,omitempty"`
+
+	// Fallback specifies the value served when the query returns no data
+	Fallback *float64 `json:"fallback,omitempty"`
+
+	// Params lists the parameters required by the query, provided as metricSelector labels by the HPA
+	Params []string `json:"params,omitempty"`
+
+	// Scale is multiplied with every value before it is served, 1 if not set
+	Scale float64 `json:"scale,omitempty"`
+
+	// Unit is one of cores, millicores or bytes and determines the format of the served quantities, defaults to cores
+	Unit string `json:"unit,omitempty"`
+}
+
+type WavefrontExternalMetricStatus struct {
+	// LastEvaluationTime is the last time the metric was evaluated
+	LastEvaluationTime *metav1.Time `json:"lastEvaluationTime,omitempty"`
+
+	// LastValue is the last value served for the metric
+	LastValue string `json:"lastValue,omitempty"`
+
+	// LastError is the error of the last evaluation, empty if it succeeded
+	LastError string `json:"lastError,omitempty"`
+}
@@ -78,7 +78,10 @@ func (w DefaultWavefrontClient) Do(verb, endpoint string, query url.Values) (*ht
 	// Check all 2xx HTTP codes
 	code := resp.StatusCode
 	if code/100 != 2 {
-		return resp, fmt.Errorf("error status=%s code=%d", resp.Status, code)
+		return resp, &Error{
+			Type: ErrBadStatus,
+			Msg:  fmt.Sprintf("error status=%s code=%d", resp.Status, code),
+		}
 	}
 	return resp, nil
 }
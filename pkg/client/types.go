@@ -4,7 +4,10 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 )
 
 // ErrorType is the type of the API error.
@@ -15,6 +18,8 @@ const (
 	ErrTimeout               = "timeout"
 	ErrCanceled              = "canceled"
 	ErrBadResponse           = "bad_response"
+	ErrBadStatus             = "bad_status"
+	ErrUnavailable           = "unavailable"
 )
 
 // Error is an error returned by the API.
@@ -27,6 +32,22 @@ func (e *Error) Error() string {
 	return fmt.Sprintf("%s: %s", e.Type, e.Msg)
 }
 
+// Category returns the type of the given error, classifying transport errors as well.
+func Category(err error) ErrorType {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return ErrCanceled
+	}
+	return ErrUnavailable
+}
+
 type Timeseries struct {
 	Label string
 	Host  string
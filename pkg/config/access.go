@@ -0,0 +1,56 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Access restricts the namespaces allowed to consume a rule. Rules without restrictions are available to every namespace.
+type Access struct {
+
+	// Namespaces lists the namespaces allowed to consume the rule
+	Namespaces []string `yaml:"namespaces,omitempty"`
+
+	// NamespaceSelector is a label selector such as 'team=payments' matching the namespaces allowed to consume the rule
+	NamespaceSelector string `yaml:"namespaceSelector,omitempty"`
+}
+
+// Restricted returns whether only some namespaces are allowed to consume the rule.
+func (a Access) Restricted() bool {
+	return len(a.Namespaces) > 0 || a.NamespaceSelector != ""
+}
+
+// Validate returns an error if the restrictions are invalid.
+func (a Access) Validate() error {
+	for _, namespace := range a.Namespaces {
+		if namespace == "" {
+			return fmt.Errorf("empty namespace")
+		}
+	}
+	if _, err := labels.Parse(a.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespace selector %q: %v", a.NamespaceSelector, err)
+	}
+	return nil
+}
+
+// Allows returns whether the namespace is allowed to consume the rule, either because it is listed
+// or because its labels match the selector. Nil labels are unknown and never match the selector.
+func (a Access) Allows(namespace string, namespaceLabels labels.Set) bool {
+	if !a.Restricted() {
+		return true
+	}
+	for _, allowed := range a.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	if a.NamespaceSelector == "" || namespaceLabels == nil {
+		return false
+	}
+	selector, err := labels.Parse(a.NamespaceSelector)
+	return err == nil && selector.Matches(namespaceLabels)
+}
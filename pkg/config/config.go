@@ -3,8 +3,27 @@
 
 package config
 
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Reductions of the points returned within the query window to a single value.
+const (
+	ReductionLast = "last"
+	ReductionAvg  = "avg"
+	ReductionMin  = "min"
+	ReductionMax  = "max"
+	ReductionSum  = "sum"
+)
+
 type ExternalMetricsConfig struct {
 	Rules []MetricRule `yaml:"rules"`
+	// Patterns describe families of external metrics resolved on demand
+	Patterns []PatternRule `yaml:"patterns,omitempty"`
+	// CustomMetrics filters and renames the discovered custom metrics
+	CustomMetrics *CustomMetricsConfig `yaml:"customMetrics,omitempty"`
 }
 
 // MetricRule describes rules for transforming Wavefront metrics to/from external metrics API resources.
@@ -15,4 +34,164 @@ type MetricRule struct {
 
 	// The unique name to assign to this metric rule
 	Name string `yaml:"name"`
+
+	// Window specifies how far back to query for points, 30s if not set
+	Window Duration `yaml:"window,omitempty"`
+
+	// Reduction specifies how the points within the window are reduced to a single value.
+	// One of last, avg, min, max or sum, defaults to last.
+	Reduction string `yaml:"reduction,omitempty"`
+
+	// Fallback specifies the value served when the query returns no data
+	Fallback *float64 `yaml:"fallback,omitempty"`
+
+	// Params lists the parameters required by the query, provided as metricSelector labels by the HPA.
+	// The query references parameters as ${name}, ${namespace} and ${cluster} are always available.
+	Params []string `yaml:"params,omitempty"`
+
+	// Conversion specifies the scale and unit of the served values
+	Conversion `yaml:",inline"`
+
+	// Transforms are applied in order to the points of every series before they are reduced
+	Transforms []Transform `yaml:"transforms,omitempty"`
+
+	// Forecast serves the projected value of every series instead of its reduced value
+	Forecast *Forecast `yaml:"forecast,omitempty"`
+
+	// Access restricts the namespaces allowed to consume the rule
+	Access `yaml:",inline"`
+
+	// Queries names the ts queries of a composite rule, which serves the value of its Expression instead of a single Query
+	Queries map[string]string `yaml:"queries,omitempty"`
+
+	// Expression combines the reduced values of the Queries, such as 'backlog / max(throughput, 1)'
+	Expression string `yaml:"expression,omitempty"`
+}
+
+// Composite returns whether the rule combines several queries through an expression.
+func (r MetricRule) Composite() bool {
+	return r.Expression != "" || len(r.Queries) > 0
+}
+
+// Validate returns an error if the rule cannot be served.
+func (r MetricRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("missing name for rule with query: %s", r.Query)
+	}
+	if r.Composite() {
+		if err := r.validateComposite(); err != nil {
+			return err
+		}
+	} else if r.Query == "" {
+		return fmt.Errorf("missing query for rule: %s", r.Name)
+	}
+	if r.Window < 0 {
+		return fmt.Errorf("negative window for rule: %s", r.Name)
+	}
+	switch r.Reduction {
+	case "", ReductionLast, ReductionAvg, ReductionMin, ReductionMax, ReductionSum:
+	default:
+		return fmt.Errorf("invalid reduction %q for rule: %s", r.Reduction, r.Name)
+	}
+	if err := r.Conversion.Validate(); err != nil {
+		return fmt.Errorf("%v for rule: %s", err, r.Name)
+	}
+	for _, transform := range r.Transforms {
+		if err := transform.Validate(); err != nil {
+			return fmt.Errorf("%v for rule: %s", err, r.Name)
+		}
+	}
+	if r.Forecast != nil {
+		if err := r.Forecast.Validate(); err != nil {
+			return fmt.Errorf("%v for rule: %s", err, r.Name)
+		}
+	}
+	if err := r.Access.Validate(); err != nil {
+		return fmt.Errorf("%v for rule: %s", err, r.Name)
+	}
+	declared := make(map[string]bool, len(r.Params))
+	for _, param := range r.Params {
+		declared[param] = true
+	}
+	for _, query := range r.AllQueries() {
+		for _, name := range Placeholders(query) {
+			if !declared[name] && !builtinParam(name) {
+				return fmt.Errorf("undeclared parameter %q in query for rule: %s", name, r.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (r MetricRule) validateComposite() error {
+	if r.Query != "" {
+		return fmt.Errorf("only one of query and queries can be specified for rule: %s", r.Name)
+	}
+	if r.Expression == "" {
+		return fmt.Errorf("missing expression for rule: %s", r.Name)
+	}
+	expression, err := ParseExpression(r.Expression)
+	if err != nil {
+		return fmt.Errorf("%v for rule: %s", err, r.Name)
+	}
+	referenced := make(map[string]bool, len(r.Queries))
+	for _, name := range expression.Operands() {
+		if r.Queries[name] == "" {
+			return fmt.Errorf("missing query for operand %q of rule: %s", name, r.Name)
+		}
+		referenced[name] = true
+	}
+	for name := range r.Queries {
+		if !referenced[name] {
+			return fmt.Errorf("query %q is not referenced by the expression of rule: %s", name, r.Name)
+		}
+	}
+	return nil
+}
+
+// QueryWindow returns how far back to query for points, which covers the lookback of a forecast.
+// Zero leaves the default window to the caller.
+func (r MetricRule) QueryWindow() time.Duration {
+	window := time.Duration(r.Window)
+	if r.Forecast != nil && r.Forecast.LookbackWindow() > window {
+		return r.Forecast.LookbackWindow()
+	}
+	return window
+}
+
+// AllQueries returns the query of the rule, or the queries of a composite rule sorted by name.
+func (r MetricRule) AllQueries() []string {
+	if !r.Composite() {
+		return []string{r.Query}
+	}
+	names := make([]string, 0, len(r.Queries))
+	for name := range r.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	queries := make([]string, len(names))
+	for i, name := range names {
+		queries[i] = r.Queries[name]
+	}
+	return queries
+}
+
+// Duration is a time.Duration read from strings such as "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
 }
@@ -0,0 +1,234 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// CustomMetricsConfig controls which of the discovered custom metrics are exposed and under which names.
+type CustomMetricsConfig struct {
+	Prefixes []MetricPrefix `yaml:"prefixes,omitempty"`
+	Filters  []MetricFilter `yaml:"filters,omitempty"`
+	Renames  []MetricRename `yaml:"renames,omitempty"`
+	// Conversions declare the scale and unit of custom metrics, the first matching conversion applies
+	Conversions []MetricConversion `yaml:"conversions,omitempty"`
+}
+
+// MetricConversion converts the values of the matching custom metrics into the served quantities.
+type MetricConversion struct {
+
+	// Resource such as pods or nodes the conversion applies to, all resources if empty
+	Resource string `yaml:"resource,omitempty"`
+
+	// Match is a regular expression matched against entire metric names such as memory.working_set
+	Match string `yaml:"match"`
+
+	Conversion `yaml:",inline"`
+}
+
+// MetricPrefix is an additional prefix custom metrics are discovered under.
+type MetricPrefix struct {
+
+	// Prefix of the Wavefront metrics such as app
+	Prefix string `yaml:"prefix"`
+
+	// Resource such as pods every metric under the prefix describes. If empty, the segment following
+	// the prefix is the resource type as for the metrics of the Kubernetes collector: <prefix>.pod.<metric>
+	Resource string `yaml:"resource,omitempty"`
+
+	// NameTag is the tag holding the name of the described object, defaults to the tag of the Kubernetes collector
+	// such as pod_name or nodename
+	NameTag string `yaml:"nameTag,omitempty"`
+
+	// NamespaceTag is the tag holding the namespace of the described object, defaults to namespace_name
+	NamespaceTag string `yaml:"namespaceTag,omitempty"`
+}
+
+// Validate returns an error if the prefix is invalid.
+func (p MetricPrefix) Validate() error {
+	if p.Prefix == "" || strings.HasPrefix(p.Prefix, ".") || strings.HasSuffix(p.Prefix, ".") {
+		return fmt.Errorf("invalid metric prefix %q", p.Prefix)
+	}
+	if strings.Contains(p.Resource, ".") {
+		return fmt.Errorf("invalid resource %q for metric prefix %s", p.Resource, p.Prefix)
+	}
+	return nil
+}
+
+// MetricFilter includes or excludes custom metrics of a resource.
+type MetricFilter struct {
+
+	// Resource such as pods or nodes the filter applies to, all resources if empty
+	Resource string `yaml:"resource,omitempty"`
+
+	// Include lists regular expressions matched against entire metric names such as cpu.usage_rate.
+	// If any filter of a resource declares includes, only metrics matching one of them are exposed.
+	Include []string `yaml:"include,omitempty"`
+
+	// Exclude lists regular expressions matched against entire metric names, excludes win over includes
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// MetricRename exposes custom metrics under a different name than the Wavefront name.
+type MetricRename struct {
+
+	// Resource such as pods or nodes the rename applies to, all resources if empty
+	Resource string `yaml:"resource,omitempty"`
+
+	// Match is a regular expression matched against entire metric names such as cpu.usage_rate
+	Match string `yaml:"match"`
+
+	// As is the exposed name, ${1}, ${2}... are replaced by the captures of Match
+	As string `yaml:"as"`
+}
+
+// CustomMetricsMapper applies a CustomMetricsConfig. A nil mapper exposes every metric unchanged.
+type CustomMetricsMapper struct {
+	filters     []metricFilter
+	renames     []metricRename
+	conversions []metricConversion
+}
+
+type metricFilter struct {
+	resource string
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+}
+
+type metricConversion struct {
+	resource   string
+	match      *regexp.Regexp
+	conversion Conversion
+}
+
+type metricRename struct {
+	resource string
+	match    *regexp.Regexp
+	as       string
+}
+
+// Compile validates the configuration and returns the mapper applying it.
+func (c CustomMetricsConfig) Compile() (*CustomMetricsMapper, error) {
+	mapper := &CustomMetricsMapper{}
+	prefixes := make(map[string]bool, len(c.Prefixes))
+	for _, prefix := range c.Prefixes {
+		if err := prefix.Validate(); err != nil {
+			return nil, err
+		}
+		if prefixes[prefix.Prefix] {
+			return nil, fmt.Errorf("duplicate metric prefix %s", prefix.Prefix)
+		}
+		prefixes[prefix.Prefix] = true
+	}
+	for _, filter := range c.Filters {
+		include, err := compileAll(filter.Include)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include for resource %q: %v", filter.Resource, err)
+		}
+		exclude, err := compileAll(filter.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude for resource %q: %v", filter.Resource, err)
+		}
+		mapper.filters = append(mapper.filters, metricFilter{resource: filter.Resource, include: include, exclude: exclude})
+	}
+	for _, rename := range c.Renames {
+		if rename.Match == "" || rename.As == "" {
+			return nil, fmt.Errorf("rename for resource %q requires match and as", rename.Resource)
+		}
+		match, err := compileEntire(rename.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rename match %q: %v", rename.Match, err)
+		}
+		mapper.renames = append(mapper.renames, metricRename{resource: rename.Resource, match: match, as: rename.As})
+	}
+	for _, conversion := range c.Conversions {
+		match, err := compileEntire(conversion.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conversion match %q: %v", conversion.Match, err)
+		}
+		if err := conversion.Conversion.Validate(); err != nil {
+			return nil, fmt.Errorf("%v for conversion of %s", err, conversion.Match)
+		}
+		mapper.conversions = append(mapper.conversions, metricConversion{resource: conversion.Resource, match: match, conversion: conversion.Conversion})
+	}
+	return mapper, nil
+}
+
+// Map returns the name the metric of the resource is exposed as, false if it is filtered out.
+// Filters apply to the Wavefront name, the first matching rename determines the exposed name.
+func (m *CustomMetricsMapper) Map(resource, metric string) (string, bool) {
+	if m == nil {
+		return metric, true
+	}
+	hasIncludes, included := false, false
+	for _, filter := range m.filters {
+		if filter.resource != "" && filter.resource != resource {
+			continue
+		}
+		if matchAny(filter.exclude, metric) {
+			return "", false
+		}
+		if len(filter.include) > 0 {
+			hasIncludes = true
+			included = included || matchAny(filter.include, metric)
+		}
+	}
+	if hasIncludes && !included {
+		return "", false
+	}
+	for _, rename := range m.renames {
+		if rename.resource != "" && rename.resource != resource {
+			continue
+		}
+		if rename.match.MatchString(metric) {
+			return rename.match.ReplaceAllString(metric, rename.as), true
+		}
+	}
+	return metric, true
+}
+
+// Conversion returns the conversion of the Wavefront metric of the resource, the zero conversion if none matches.
+func (m *CustomMetricsMapper) Conversion(resource, metric string) Conversion {
+	if m == nil {
+		return Conversion{}
+	}
+	for _, conversion := range m.conversions {
+		if conversion.resource != "" && conversion.resource != resource {
+			continue
+		}
+		if conversion.match.MatchString(metric) {
+			return conversion.conversion
+		}
+	}
+	return Conversion{}
+}
+
+func compileAll(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := compileEntire(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// compileEntire compiles a regular expression matching entire strings only
+func compileEntire(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+func matchAny(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
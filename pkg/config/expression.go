@@ -0,0 +1,305 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Expression is an arithmetic expression over the values of named queries, such as 'backlog / max(throughput, 1)'.
+// It supports numbers, operands, +, -, *, /, parentheses and the min and max functions.
+type Expression struct {
+	root     node
+	operands []string
+}
+
+// ParseExpression parses the expression, returning an error describing the first invalid token.
+func ParseExpression(s string) (*Expression, error) {
+	p := &parser{input: s, operands: make(map[string]bool)}
+	p.next()
+	root, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEnd {
+		return nil, p.unexpected()
+	}
+
+	operands := make([]string, 0, len(p.operands))
+	for name := range p.operands {
+		operands = append(operands, name)
+	}
+	sort.Strings(operands)
+	return &Expression{root: root, operands: operands}, nil
+}
+
+// Operands returns the sorted names of the operands referenced by the expression.
+func (e *Expression) Operands() []string {
+	return e.operands
+}
+
+// Evaluate returns the value of the expression for the given operand values. Missing operands are NaN.
+func (e *Expression) Evaluate(values map[string]float64) float64 {
+	return e.root.eval(values)
+}
+
+type node interface {
+	eval(values map[string]float64) float64
+}
+
+type number float64
+
+func (n number) eval(map[string]float64) float64 {
+	return float64(n)
+}
+
+type operand string
+
+func (o operand) eval(values map[string]float64) float64 {
+	value, found := values[string(o)]
+	if !found {
+		return math.NaN()
+	}
+	return value
+}
+
+type negation struct {
+	node node
+}
+
+func (n negation) eval(values map[string]float64) float64 {
+	return -n.node.eval(values)
+}
+
+type binary struct {
+	op          byte
+	left, right node
+}
+
+func (b binary) eval(values map[string]float64) float64 {
+	left, right := b.left.eval(values), b.right.eval(values)
+	switch b.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+type call struct {
+	fn   func(a, b float64) float64
+	args []node
+}
+
+func (c call) eval(values map[string]float64) float64 {
+	result := c.args[0].eval(values)
+	for _, arg := range c.args[1:] {
+		result = c.fn(result, arg.eval(values))
+	}
+	return result
+}
+
+var functions = map[string]func(a, b float64) float64{
+	"min": math.Min,
+	"max": math.Max,
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenSymbol
+	tokenInvalid
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value float64
+	pos   int
+}
+
+// parser is a recursive descent parser of the grammar:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | operand | function "(" expression { "," expression } ")" | "(" expression ")"
+type parser struct {
+	input    string
+	pos      int
+	token    token
+	operands map[string]bool
+}
+
+func (p *parser) next() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos == len(p.input) {
+		p.token = token{kind: tokenEnd, pos: start}
+		return
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case isDigit(c) || c == '.':
+		for p.pos < len(p.input) && (isDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		if p.pos < len(p.input) && (p.input[p.pos] == 'e' || p.input[p.pos] == 'E') {
+			p.pos++
+			if p.pos < len(p.input) && (p.input[p.pos] == '+' || p.input[p.pos] == '-') {
+				p.pos++
+			}
+			for p.pos < len(p.input) && isDigit(p.input[p.pos]) {
+				p.pos++
+			}
+		}
+		text := p.input[start:p.pos]
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.token = token{kind: tokenInvalid, text: text, pos: start}
+			return
+		}
+		p.token = token{kind: tokenNumber, text: text, value: value, pos: start}
+	case isIdentStart(c):
+		for p.pos < len(p.input) && (isIdentStart(p.input[p.pos]) || isDigit(p.input[p.pos])) {
+			p.pos++
+		}
+		p.token = token{kind: tokenIdent, text: p.input[start:p.pos], pos: start}
+	case c == '+' || c == '-' || c == '*' || c == '/' || c == '(' || c == ')' || c == ',':
+		p.pos++
+		p.token = token{kind: tokenSymbol, text: string(c), pos: start}
+	default:
+		p.pos++
+		p.token = token{kind: tokenInvalid, text: string(c), pos: start}
+	}
+}
+
+func (p *parser) expression() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.symbol("+") || p.symbol("-") {
+		op := p.token.text[0]
+		p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) term() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.symbol("*") || p.symbol("/") {
+		op := p.token.text[0]
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.symbol("-") {
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negation{node: n}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	switch {
+	case p.token.kind == tokenNumber:
+		n := number(p.token.value)
+		p.next()
+		return n, nil
+	case p.token.kind == tokenIdent:
+		name := p.token.text
+		p.next()
+		if !p.symbol("(") {
+			p.operands[name] = true
+			return operand(name), nil
+		}
+		fn, found := functions[name]
+		if !found {
+			return nil, fmt.Errorf("unknown function %q in expression: %s", name, p.input)
+		}
+		p.next()
+		c := call{fn: fn}
+		for {
+			arg, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+			if !p.symbol(",") {
+				break
+			}
+			p.next()
+		}
+		if !p.symbol(")") {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return c, nil
+	case p.symbol("("):
+		p.next()
+		n, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if !p.symbol(")") {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return n, nil
+	default:
+		return nil, p.unexpected()
+	}
+}
+
+func (p *parser) symbol(s string) bool {
+	return p.token.kind == tokenSymbol && p.token.text == s
+}
+
+func (p *parser) unexpected() error {
+	if p.token.kind == tokenEnd {
+		return fmt.Errorf("unexpected end of expression: %s", p.input)
+	}
+	return fmt.Errorf("unexpected %q at position %d in expression: %s", p.token.text, p.token.pos+1, p.input)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,113 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Models projecting the points of a series ahead.
+const (
+	// ModelLinear fits a least squares line through the points
+	ModelLinear = "linear"
+	// ModelHolt applies double exponential smoothing, following the level and trend of the points
+	ModelHolt = "holt"
+)
+
+// Defaults of the forecast options.
+const (
+	DefaultForecastLookback = time.Hour
+	DefaultForecastMinRatio = 0.5
+	DefaultForecastMaxRatio = 2
+	DefaultHoltAlpha        = 0.5
+	DefaultHoltBeta         = 0.1
+)
+
+// Forecast serves the value a series is projected to reach after the horizon instead of its current value.
+type Forecast struct {
+
+	// Model is one of linear or holt
+	Model string `yaml:"model"`
+
+	// Horizon specifies how far ahead to project the series
+	Horizon Duration `yaml:"horizon"`
+
+	// Lookback specifies how far back to query for the points the model is fit to, 1h if not set
+	Lookback Duration `yaml:"lookback,omitempty"`
+
+	// Alpha is the smoothing factor of the level of the holt model, 0.5 if not set
+	Alpha float64 `yaml:"alpha,omitempty"`
+
+	// Beta is the smoothing factor of the trend of the holt model, 0.1 if not set
+	Beta float64 `yaml:"beta,omitempty"`
+
+	// MinRatio bounds the forecast to at least this ratio of the actual value, 0.5 if not set
+	MinRatio *float64 `yaml:"minRatio,omitempty"`
+
+	// MaxRatio bounds the forecast to at most this ratio of the actual value, 2 if not set
+	MaxRatio *float64 `yaml:"maxRatio,omitempty"`
+
+	// Ceiling is a value the forecast may always reach, even beyond MaxRatio times the actual value.
+	// It lets forecasts lead scaling up from values at or near 0.
+	Ceiling *float64 `yaml:"ceiling,omitempty"`
+}
+
+// Validate returns an error if the forecast is invalid.
+func (f Forecast) Validate() error {
+	switch f.Model {
+	case ModelLinear, ModelHolt:
+	default:
+		return fmt.Errorf("invalid forecast model %q", f.Model)
+	}
+	if f.Horizon <= 0 {
+		return fmt.Errorf("missing forecast horizon")
+	}
+	if f.Lookback < 0 {
+		return fmt.Errorf("negative forecast lookback")
+	}
+	if f.Alpha < 0 || f.Alpha > 1 || f.Beta < 0 || f.Beta > 1 {
+		return fmt.Errorf("forecast alpha and beta must be between 0 and 1")
+	}
+	min, max := f.Ratios()
+	if min < 0 || min > max {
+		return fmt.Errorf("invalid forecast ratios from %v to %v", min, max)
+	}
+	if f.Ceiling != nil && *f.Ceiling < 0 {
+		return fmt.Errorf("negative forecast ceiling %v", *f.Ceiling)
+	}
+	return nil
+}
+
+// LookbackWindow returns the window the model is fit to.
+func (f Forecast) LookbackWindow() time.Duration {
+	if f.Lookback == 0 {
+		return DefaultForecastLookback
+	}
+	return time.Duration(f.Lookback)
+}
+
+// Smoothing returns the alpha and beta factors of the holt model.
+func (f Forecast) Smoothing() (float64, float64) {
+	alpha, beta := f.Alpha, f.Beta
+	if alpha == 0 {
+		alpha = DefaultHoltAlpha
+	}
+	if beta == 0 {
+		beta = DefaultHoltBeta
+	}
+	return alpha, beta
+}
+
+// Ratios returns the bounds of the forecast relative to the actual value.
+func (f Forecast) Ratios() (float64, float64) {
+	min, max := DefaultForecastMinRatio, float64(DefaultForecastMaxRatio)
+	if f.MinRatio != nil {
+		min = *f.MinRatio
+	}
+	if f.MaxRatio != nil {
+		max = *f.MaxRatio
+	}
+	return min, max
+}
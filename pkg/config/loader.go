@@ -29,5 +29,20 @@ func FromYAML(contents []byte) (*ExternalMetricsConfig, error) {
 	if err := yaml.UnmarshalStrict(contents, &cfg); err != nil {
 		return nil, fmt.Errorf("unable to parse metrics discovery config: %v", err)
 	}
+	for _, rule := range cfg.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid metrics discovery config: %v", err)
+		}
+	}
+	for i := range cfg.Patterns {
+		if err := cfg.Patterns[i].Compile(); err != nil {
+			return nil, fmt.Errorf("invalid metrics discovery config: %v", err)
+		}
+	}
+	if cfg.CustomMetrics != nil {
+		if _, err := cfg.CustomMetrics.Compile(); err != nil {
+			return nil, fmt.Errorf("invalid custom metrics config: %v", err)
+		}
+	}
 	return &cfg, nil
 }
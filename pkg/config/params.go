@@ -0,0 +1,48 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Parameters always available to rule queries.
+const (
+	// NamespaceParam is the namespace of the request
+	NamespaceParam = "namespace"
+	// ClusterParam is the name of the cluster the adapter runs in
+	ClusterParam = "cluster"
+)
+
+// placeholderPattern matches placeholders of the form ${name} within rule queries
+var placeholderPattern = regexp.MustCompile(`\$\{([A-Za-z0-9_.\-/]+)\}`)
+
+// Placeholders returns the names of the parameters referenced by the query in order of appearance.
+func Placeholders(query string) []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(query, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// ReplacePlaceholders replaces each placeholder of the query with the result of the given function.
+func ReplacePlaceholders(query string, replace func(name string) string) string {
+	return placeholderPattern.ReplaceAllStringFunc(query, func(placeholder string) string {
+		return replace(placeholderPattern.FindStringSubmatch(placeholder)[1])
+	})
+}
+
+// escaper escapes values substituted within double quoted ts query strings
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// EscapeValue escapes a value so it cannot change the structure of the query it is substituted into.
+func EscapeValue(value string) string {
+	return escaper.Replace(value)
+}
+
+func builtinParam(name string) bool {
+	return name == NamespaceParam || name == ClusterParam
+}
@@ -0,0 +1,166 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PatternRule describes a family of external metrics whose names match a pattern.
+type PatternRule struct {
+
+	// Pattern is a regular expression matched against entire metric names, e.g. sqs_depth_(.+)
+	Pattern string `yaml:"pattern"`
+
+	// Query specifies a Wavefront ts query, ${1}, ${2}... are replaced by the captures of the pattern
+	Query string `yaml:"query"`
+
+	// Window specifies how far back to query for points, 30s if not set
+	Window Duration `yaml:"window,omitempty"`
+
+	// Reduction specifies how the points within the window are reduced to a single value
+	Reduction string `yaml:"reduction,omitempty"`
+
+	// Fallback specifies the value served when the query returns no data
+	Fallback *float64 `yaml:"fallback,omitempty"`
+
+	// Params lists the parameters required by the query, provided as metricSelector labels by the HPA
+	Params []string `yaml:"params,omitempty"`
+
+	// Names lists the metric names of the family exposed through discovery
+	Names []string `yaml:"names,omitempty"`
+
+	// Discovery exposes a metric name for every value of a tag
+	Discovery *TagDiscovery `yaml:"discovery,omitempty"`
+
+	// Conversion specifies the scale and unit of the served values
+	Conversion `yaml:",inline"`
+
+	// Transforms are applied in order to the points of every series before they are reduced
+	Transforms []Transform `yaml:"transforms,omitempty"`
+
+	// Forecast serves the projected value of every series instead of its reduced value
+	Forecast *Forecast `yaml:"forecast,omitempty"`
+
+	// Access restricts the namespaces allowed to consume the metrics of the family
+	Access `yaml:",inline"`
+
+	// compiled is the pattern compiled by Compile
+	compiled *regexp.Regexp
+}
+
+// TagDiscovery lists the metric names of a family from the values a tag takes across the series of a query.
+type TagDiscovery struct {
+
+	// Query specifies a Wavefront ts query returning the series to collect tag values from
+	Query string `yaml:"query"`
+
+	// Tag is the point tag whose values are collected
+	Tag string `yaml:"tag"`
+
+	// Name is the metric name exposed for each value, ${1} is replaced by the value
+	Name string `yaml:"name"`
+}
+
+// Validate returns an error if the pattern cannot be served.
+func (p PatternRule) Validate() error {
+	_, err := p.validate()
+	return err
+}
+
+// Compile validates the rule and compiles its pattern once for every later match.
+// Patterns loaded by FromYAML are compiled, a rule that was not compiled never matches.
+func (p *PatternRule) Compile() error {
+	re, err := p.validate()
+	if err != nil {
+		return err
+	}
+	p.compiled = re
+	return nil
+}
+
+func (p PatternRule) validate() (*regexp.Regexp, error) {
+	if p.Pattern == "" {
+		return nil, fmt.Errorf("missing pattern")
+	}
+	re, err := compileEntire(p.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", p.Pattern, err)
+	}
+	for _, name := range Placeholders(p.Query) {
+		if index, err := strconv.Atoi(name); err == nil && (index < 1 || index > re.NumSubexp()) {
+			return nil, fmt.Errorf("query references missing capture ${%d} for pattern: %s", index, p.Pattern)
+		}
+	}
+	for _, name := range p.Names {
+		if !re.MatchString(name) {
+			return nil, fmt.Errorf("name %q does not match pattern: %s", name, p.Pattern)
+		}
+	}
+	if d := p.Discovery; d != nil && (d.Query == "" || d.Tag == "" || d.Name == "") {
+		return nil, fmt.Errorf("discovery requires a query, tag and name for pattern: %s", p.Pattern)
+	}
+	// captures are empty for validation, the remaining fields are validated as for any rule
+	return re, p.rule(p.Pattern, make([]string, re.NumSubexp()+1)).Validate()
+}
+
+// Match returns the rule serving the given metric name if it matches the pattern.
+func (p PatternRule) Match(name string) (MetricRule, bool) {
+	if p.compiled == nil {
+		return MetricRule{}, false
+	}
+	captures := p.compiled.FindStringSubmatch(name)
+	if captures == nil {
+		return MetricRule{}, false
+	}
+	for _, capture := range captures[1:] {
+		// captures are substituted before the parameters of the request, they must not add placeholders
+		if strings.Contains(capture, "$") {
+			return MetricRule{}, false
+		}
+	}
+	return p.rule(name, captures), true
+}
+
+// DiscoveredName returns the metric name exposed for the given tag value, if it matches the pattern.
+func (p PatternRule) DiscoveredName(value string) (string, bool) {
+	if p.Discovery == nil || p.compiled == nil || strings.Contains(value, "$") {
+		return "", false
+	}
+	name := ReplacePlaceholders(p.Discovery.Name, func(placeholder string) string {
+		if placeholder == "1" {
+			return value
+		}
+		return "${" + placeholder + "}"
+	})
+	if !p.compiled.MatchString(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// rule substitutes the escaped captures for their placeholders, other placeholders are left for the request.
+func (p PatternRule) rule(name string, captures []string) MetricRule {
+	query := ReplacePlaceholders(p.Query, func(placeholder string) string {
+		if index, err := strconv.Atoi(placeholder); err == nil && index > 0 && index < len(captures) {
+			return EscapeValue(captures[index])
+		}
+		return "${" + placeholder + "}"
+	})
+	return MetricRule{
+		Name:       name,
+		Query:      query,
+		Window:     p.Window,
+		Reduction:  p.Reduction,
+		Fallback:   p.Fallback,
+		Params:     p.Params,
+		Conversion: p.Conversion,
+		Transforms: p.Transforms,
+		Forecast:   p.Forecast,
+		Access:     p.Access,
+	}
+}
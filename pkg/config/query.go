@@ -0,0 +1,59 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// queryStartPattern matches the function call every ts query starts with, e.g. ts( or mavg(
+var queryStartPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*\s*\(`)
+
+// CheckQuerySyntax returns an error if the query is not a well formed ts query:
+// it must start with a function call, with balanced brackets and terminated string literals.
+// It does not check the functions or metrics referenced by the query.
+func CheckQuerySyntax(query string) error {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return fmt.Errorf("empty query")
+	}
+	if !queryStartPattern.MatchString(query) {
+		return fmt.Errorf("query must start with a function call such as ts(...)")
+	}
+
+	closing := map[rune]rune{')': '(', ']': '[', '}': '{'}
+	var open []rune
+	var quote rune
+	escaped := false
+	for i, c := range query {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			open = append(open, c)
+		case closing[c] != 0:
+			if len(open) == 0 || open[len(open)-1] != closing[c] {
+				return fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("unterminated string literal")
+	}
+	if len(open) > 0 {
+		return fmt.Errorf("unclosed %q", open[len(open)-1])
+	}
+	return nil
+}
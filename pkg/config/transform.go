@@ -0,0 +1,59 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"math"
+)
+
+// Types of the transforms applied to the points of every series before they are reduced.
+const (
+	// TransformRate replaces the points of a monotonic counter with its per-second rate, counter resets restart from 0
+	TransformRate = "rate"
+	// TransformEWMA smooths the points with an exponentially weighted moving average
+	TransformEWMA = "ewma"
+	// TransformClamp bounds every point to the range from Min to Max
+	TransformClamp = "clamp"
+)
+
+// Transform is applied by the adapter to the points returned within the query window.
+type Transform struct {
+
+	// Type is one of rate, ewma or clamp
+	Type string `yaml:"type"`
+
+	// HalfLife is the age at which the weight of a point halves, required by ewma
+	HalfLife Duration `yaml:"halfLife,omitempty"`
+
+	// Min is the lower bound of clamp, unbounded if not set
+	Min *float64 `yaml:"min,omitempty"`
+
+	// Max is the upper bound of clamp, unbounded if not set
+	Max *float64 `yaml:"max,omitempty"`
+}
+
+// Validate returns an error if the transform is invalid.
+func (t Transform) Validate() error {
+	switch t.Type {
+	case TransformRate:
+	case TransformEWMA:
+		if t.HalfLife <= 0 {
+			return fmt.Errorf("missing halfLife for transform %s", t.Type)
+		}
+	case TransformClamp:
+		if t.Min == nil && t.Max == nil {
+			return fmt.Errorf("missing min or max for transform %s", t.Type)
+		}
+		if (t.Min != nil && math.IsNaN(*t.Min)) || (t.Max != nil && math.IsNaN(*t.Max)) {
+			return fmt.Errorf("invalid bounds for transform %s", t.Type)
+		}
+		if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+			return fmt.Errorf("min %v exceeds max %v for transform %s", *t.Min, *t.Max, t.Type)
+		}
+	default:
+		return fmt.Errorf("invalid transform %q", t.Type)
+	}
+	return nil
+}
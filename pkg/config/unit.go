@@ -0,0 +1,50 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package config
+
+import (
+	"fmt"
+	"math"
+)
+
+// Units of the served quantities.
+const (
+	// UnitCores serves values as decimal quantities with milli precision such as 250m, the default
+	UnitCores = "cores"
+	// UnitMillicores serves values given in millicores as cores, 250 is served as 250m
+	UnitMillicores = "millicores"
+	// UnitBytes serves values as whole binary quantities such as 500Mi
+	UnitBytes = "bytes"
+)
+
+// Conversion converts the values of a metric into the served quantities.
+type Conversion struct {
+
+	// Scale is multiplied with every value before it is served, 1 if not set
+	Scale float64 `yaml:"scale,omitempty"`
+
+	// Unit is one of cores, millicores or bytes and determines the format of the served quantities, defaults to cores
+	Unit string `yaml:"unit,omitempty"`
+}
+
+// Validate returns an error if the conversion is invalid.
+func (c Conversion) Validate() error {
+	if c.Scale < 0 || math.IsNaN(c.Scale) || math.IsInf(c.Scale, 0) {
+		return fmt.Errorf("invalid scale %v", c.Scale)
+	}
+	switch c.Unit {
+	case "", UnitCores, UnitMillicores, UnitBytes:
+	default:
+		return fmt.Errorf("invalid unit %q", c.Unit)
+	}
+	return nil
+}
+
+// Apply returns the value scaled as configured.
+func (c Conversion) Apply(value float64) float64 {
+	if c.Scale == 0 {
+		return value
+	}
+	return value * c.Scale
+}
@@ -0,0 +1,6 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package externalscaler holds the ExternalScaler gRPC service of KEDA, generated from the
+// externalscaler.proto of github.com/kedacore/keda v2.10.0, which is licensed under Apache-2.0.
+package externalscaler
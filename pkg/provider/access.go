@@ -0,0 +1,113 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// namespaceSyncTimeout is how long the query subcommand waits for namespaces to be listed
+const namespaceSyncTimeout = 30 * time.Second
+
+// waitForSync waits until synced returns true or the timeout expires, returning whether it synced.
+func waitForSync(synced cache.InformerSynced, timeout time.Duration) bool {
+	stopCh := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() { close(stopCh) })
+	defer timer.Stop()
+	return cache.WaitForCacheSync(stopCh, synced)
+}
+
+// namespaceWatcher caches the labels of namespaces for namespace selectors of rules.
+// Namespaces are only watched once the first rule with a namespace selector is set.
+type namespaceWatcher struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.NamespaceLister
+	synced  cache.InformerSynced
+	stopCh  <-chan struct{}
+	once    sync.Once
+	started int32
+}
+
+func newNamespaceWatcher(client kubernetes.Interface, stopCh <-chan struct{}) *namespaceWatcher {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Core().V1().Namespaces()
+	return &namespaceWatcher{
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+		stopCh:  stopCh,
+	}
+}
+
+// start watches namespaces, only the first call has an effect.
+func (w *namespaceWatcher) start() {
+	w.once.Do(func() {
+		log.Info("watching namespaces for namespace selectors of external metrics")
+		w.factory.Start(w.stopCh)
+		atomic.StoreInt32(&w.started, 1)
+	})
+}
+
+// hasSynced returns true unless namespaces are watched and have not been listed yet.
+func (w *namespaceWatcher) hasSynced() bool {
+	return atomic.LoadInt32(&w.started) == 0 || w.synced()
+}
+
+// labels returns the labels of the namespace, or nil if the namespace does not exist.
+// An error is returned until namespaces have been listed, as their labels are unknown.
+func (w *namespaceWatcher) labels(name string) (labels.Set, error) {
+	w.start()
+	if !w.synced() {
+		return nil, fmt.Errorf("namespaces have not been listed yet")
+	}
+	namespace, err := w.lister.Get(name)
+	if err != nil {
+		log.Debugf("labels of namespace %s are unknown: %v", name, err)
+		return nil, nil
+	}
+	// namespaces without labels are known and match selectors such as !team
+	set := make(labels.Set, len(namespace.Labels))
+	for k, v := range namespace.Labels {
+		set[k] = v
+	}
+	return set, nil
+}
+
+// watchNamespacesFor starts watching namespaces once the first rule restricting its namespaces with a selector is set,
+// so that their labels are known by the time the rule is requested.
+func (d *WavefrontExternalDriver) watchNamespacesFor(access config.Access) {
+	if access.NamespaceSelector != "" && d.namespaces != nil {
+		d.namespaces.start()
+	}
+}
+
+// checkAccess returns a Forbidden error if the namespace may not consume the rule,
+// or a ServiceUnavailable error while this cannot be determined yet.
+func (p *wavefrontProvider) checkAccess(namespace string, rule config.MetricRule) error {
+	allowed, err := p.externalDriver.allowed(namespace, rule)
+	if err != nil {
+		return apierr.NewServiceUnavailable(fmt.Sprintf("unable to check access to external metric %s: %v", rule.Name, err))
+	}
+	if !allowed {
+		return apierr.NewForbidden(schema.GroupResource{Group: external_metrics.GroupName, Resource: rule.Name}, "",
+			fmt.Errorf("external metric %s is not available in namespace %s", rule.Name, namespace))
+	}
+	return nil
+}
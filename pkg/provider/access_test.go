@@ -0,0 +1,181 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/keda/externalscaler"
+)
+
+func TestAccessAllows(t *testing.T) {
+	assert.True(t, config.Access{}.Allows("default", nil))
+
+	listed := config.Access{Namespaces: []string{"payments", "orders"}}
+	assert.True(t, listed.Allows("orders", nil))
+	assert.False(t, listed.Allows("default", labels.Set{}))
+
+	selected := config.Access{Namespaces: []string{"orders"}, NamespaceSelector: "team=payments"}
+	assert.True(t, selected.Allows("orders", nil))
+	assert.True(t, selected.Allows("billing", labels.Set{"team": "payments"}))
+	assert.False(t, selected.Allows("billing", labels.Set{"team": "search"}))
+	// unknown namespaces never match the selector, even a negative one
+	assert.False(t, config.Access{NamespaceSelector: "!team"}.Allows("billing", nil))
+	assert.True(t, config.Access{NamespaceSelector: "!team"}.Allows("billing", labels.Set{}))
+}
+
+func TestValidateAccess(t *testing.T) {
+	rule := config.MetricRule{Name: "r", Query: "ts(a)", Access: config.Access{Namespaces: []string{""}}}
+	assert.EqualError(t, rule.Validate(), "empty namespace for rule: r")
+	rule.Access = config.Access{NamespaceSelector: "team in payments"}
+	assert.Error(t, rule.Validate())
+	rule.Access = config.Access{Namespaces: []string{"orders"}, NamespaceSelector: "team in (payments, billing)"}
+	assert.NoError(t, rule.Validate())
+}
+
+func restrictedDriver() *WavefrontExternalDriver {
+	return restrictedDriverWith(nil)
+}
+
+// restrictedDriverWith returns a driver with restricted rules, reading the labels of namespaces from the client if set.
+func restrictedDriverWith(client kubernetes.Interface) *WavefrontExternalDriver {
+	driver := newWavefrontExternalDriver()
+	if client != nil {
+		driver.namespaces = newNamespaceWatcher(client, wait.NeverStop)
+	}
+	driver.setRules(ruleSource{kind: fileSourceKind}, []config.MetricRule{
+		{Name: "shared_queue", Query: "ts(queue.size)"},
+		{Name: "payments_queue", Query: "ts(payments.queue.size)", Access: config.Access{Namespaces: []string{"payments"}}},
+		{Name: "team_queue", Query: "ts(team.queue.size)", Access: config.Access{NamespaceSelector: "team=payments"}},
+	})
+	return driver
+}
+
+func TestRestrictedMetricNames(t *testing.T) {
+	driver := restrictedDriver()
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "default", name: "hpa"}, []config.MetricRule{{Name: "hpa_queue", Query: "ts(hpa.queue.size)"}})
+
+	// the list is not namespaced, restricted rules and rules of namespaced sources are left out
+	assert.Equal(t, []string{"shared_queue"}, driver.getMetricNames())
+}
+
+func TestGetRestrictedMetric(t *testing.T) {
+	driver := restrictedDriverWith(fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "billing", Labels: map[string]string{"team": "payments"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "search", Labels: map[string]string{"team": "search"}}},
+	))
+	// namespaces are watched as soon as a rule has a namespace selector, and gate readiness
+	assert.True(t, cache.WaitForCacheSync(wait.NeverStop, driver.hasSynced))
+
+	waveClient := &seriesClient{series: map[string][]client.Timeseries{
+		"payments.queue.size": {valueSeries("a", 10)},
+		"team.queue.size":     {valueSeries("a", 20)},
+	}}
+	p := &wavefrontProvider{waveClient: waveClient, externalDriver: driver, Translator: NewWavefrontTranslator("kubernetes")}
+	get := func(namespace, metric string) (string, error) {
+		values, err := p.GetExternalMetric(context.Background(), namespace, labels.Everything(), provider.ExternalMetricInfo{Metric: metric})
+		if err != nil {
+			return "", err
+		}
+		return values.Items[0].Value.String(), nil
+	}
+
+	value, err := get("payments", "payments_queue")
+	assert.NoError(t, err)
+	assert.Equal(t, "10", value)
+
+	_, err = get("default", "payments_queue")
+	assert.True(t, apierr.IsForbidden(err))
+	assert.Contains(t, err.Error(), "external metric payments_queue is not available in namespace default")
+	// denied requests never reach Wavefront
+	assert.Len(t, waveClient.queries, 1)
+
+	value, err = get("billing", "team_queue")
+	assert.NoError(t, err)
+	assert.Equal(t, "20", value)
+	_, err = get("search", "team_queue")
+	assert.True(t, apierr.IsForbidden(err))
+	_, err = get("unknown", "team_queue")
+	assert.True(t, apierr.IsForbidden(err))
+
+	// unknown rules and rules of other namespaces are not found rather than failing the adapter
+	_, err = get("payments", "missing_queue")
+	assert.True(t, apierr.IsNotFound(err))
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "orders", name: "hpa"}, []config.MetricRule{{Name: "orders_queue", Query: "ts(orders.queue.size)"}})
+	_, err = get("payments", "orders_queue")
+	assert.True(t, apierr.IsNotFound(err))
+	_, err = p.ExplainExternalMetric("payments", labels.Everything(), provider.ExternalMetricInfo{Metric: "orders_queue"})
+	assert.True(t, apierr.IsNotFound(err))
+
+	// the query subcommand reports the same outcome
+	_, err = p.ExplainExternalMetric("default", labels.Everything(), provider.ExternalMetricInfo{Metric: "payments_queue"})
+	assert.True(t, apierr.IsForbidden(err))
+	explanation, err := p.ExplainExternalMetric("billing", labels.Everything(), provider.ExternalMetricInfo{Metric: "team_queue"})
+	assert.NoError(t, err)
+	assert.Equal(t, "20", explanation.Served[0].Quantity)
+}
+
+func TestUnlistedNamespaces(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeClient.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("unavailable")
+	})
+	driver := restrictedDriverWith(kubeClient)
+	p := &wavefrontProvider{waveClient: &seriesClient{}, externalDriver: driver, Translator: NewWavefrontTranslator("kubernetes")}
+	assert.False(t, driver.hasSynced())
+
+	// selectors cannot be checked until namespaces are listed, which is retriable
+	_, err := p.GetExternalMetric(context.Background(), "billing", labels.Everything(), provider.ExternalMetricInfo{Metric: "team_queue"})
+	assert.True(t, apierr.IsServiceUnavailable(err))
+	// listed namespaces and unrestricted rules do not depend on labels
+	_, err = p.GetExternalMetric(context.Background(), "payments", labels.Everything(), provider.ExternalMetricInfo{Metric: "payments_queue"})
+	assert.False(t, apierr.IsServiceUnavailable(err))
+
+	_, err = p.ExternalScaler(false).GetMetricSpec(context.Background(), &externalscaler.ScaledObjectRef{
+		Name: "worker", Namespace: "billing",
+		ScalerMetadata: map[string]string{scalerMetricName: "team_queue", scalerTargetValue: "10"},
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	errs, warnings := (&hpaValidator{driver: driver}).validate(externalHPA("billing", "hpa", nil, "team_queue"))
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"unable to check access to external metric team_queue: namespaces have not been listed yet"}, warnings)
+}
+
+func TestRestrictedScalerAndAdmission(t *testing.T) {
+	driver := restrictedDriver()
+	p := &wavefrontProvider{waveClient: &seriesClient{}, externalDriver: driver, Translator: NewWavefrontTranslator("kubernetes")}
+	scaler := p.ExternalScaler(false)
+	_, err := scaler.GetMetricSpec(context.Background(), &externalscaler.ScaledObjectRef{
+		Name: "worker", Namespace: "default",
+		ScalerMetadata: map[string]string{scalerMetricName: "payments_queue", scalerTargetValue: "10"},
+	})
+	assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = external metric payments_queue is not available in namespace default")
+
+	validator := &hpaValidator{driver: driver}
+	errs, _ := validator.validate(externalHPA("default", "hpa", nil, "payments_queue"))
+	assert.Equal(t, []string{"external metric payments_queue is not available in namespace default"}, errs)
+	errs, _ = validator.validate(externalHPA("payments", "hpa", nil, "payments_queue"))
+	assert.Empty(t, errs)
+}
@@ -0,0 +1,203 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	"k8s.io/apimachinery/pkg/api/validation/path"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// AdmissionWebhookPath is the path the HPA validating admission webhook is served on
+const AdmissionWebhookPath = "/validate-hpa"
+
+// AdmissionProvider is implemented by providers able to validate HPAs before they are admitted.
+type AdmissionProvider interface {
+	AdmissionHandler() http.Handler
+}
+
+// AdmissionHandler returns a handler serving AdmissionReview requests for HPAs.
+// HPAs with invalid metric annotations or unknown external metrics are rejected,
+// collisions with existing rules are returned as admission warnings.
+func (p *wavefrontProvider) AdmissionHandler() http.Handler {
+	return &hpaValidator{driver: p.externalDriver}
+}
+
+var _ AdmissionProvider = &wavefrontProvider{}
+
+type hpaValidator struct {
+	driver ExternalMetricsDriver
+}
+
+func (v *hpaValidator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review.Response = v.review(review.Request)
+	review.Response.UID = review.Request.UID
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Errorf("unable to write admission response: %v", err)
+	}
+}
+
+func (v *hpaValidator) review(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	var hpa v2.HorizontalPodAutoscaler
+	if err := json.Unmarshal(request.Object.Raw, &hpa); err != nil {
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result:  &metav1.Status{Message: fmt.Sprintf("unable to decode HorizontalPodAutoscaler: %v", err)},
+		}
+	}
+	if hpa.Namespace == "" {
+		hpa.Namespace = request.Namespace
+	}
+
+	errs, warnings := v.validate(&hpa)
+	response := &admissionv1.AdmissionResponse{
+		Allowed:  len(errs) == 0,
+		Warnings: warnings,
+	}
+	if len(errs) > 0 {
+		log.Infof("rejected HorizontalPodAutoscaler %s/%s: %v", hpa.Namespace, hpa.Name, errs)
+		response.Result = &metav1.Status{
+			Message: strings.Join(errs, "; "),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	return response
+}
+
+// validate returns the errors rejecting the HPA and the warnings it is admitted with.
+func (v *hpaValidator) validate(hpa *v2.HorizontalPodAutoscaler) ([]string, []string) {
+	var errs, warnings []string
+
+	keys := make([]string, 0, len(hpa.Annotations))
+	for k := range hpa.Annotations {
+		if strings.HasPrefix(k, metricAnnotationPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	declared := make(map[string]bool, len(keys))
+	source := hpaSource(hpa)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, metricAnnotationPrefix+"/") {
+			errs = append(errs, fmt.Sprintf("annotation %s must be of the form %s/<metric name>", k, metricAnnotationPrefix))
+			continue
+		}
+		rule := annotationRule(k[len(metricAnnotationPrefix)+1:], hpa.Annotations[k])
+		if ruleErrs := validateAnnotationRule(rule); len(ruleErrs) > 0 {
+			errs = append(errs, ruleErrs...)
+			continue
+		}
+		declared[rule.Name] = true
+		warnings = append(warnings, v.collisions(source, rule)...)
+	}
+
+	for _, metric := range hpa.Spec.Metrics {
+		if metric.Type != v2.ExternalMetricSourceType || metric.External == nil {
+			continue
+		}
+		name := metric.External.Metric.Name
+		if declared[name] {
+			continue
+		}
+		rule, found := v.driver.getRule(hpa.Namespace, name)
+		if !found {
+			errs = append(errs, fmt.Sprintf("external metric %s is neither declared by a %s/%s annotation nor by a known rule",
+				name, metricAnnotationPrefix, name))
+			continue
+		}
+		// admission does not wait for namespaces to be listed, requests are checked again when served
+		allowed, err := v.driver.allowed(hpa.Namespace, rule)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("unable to check access to external metric %s: %v", name, err))
+		} else if !allowed {
+			errs = append(errs, fmt.Sprintf("external metric %s is not available in namespace %s", name, hpa.Namespace))
+		}
+	}
+	return errs, warnings
+}
+
+func validateAnnotationRule(rule config.MetricRule) []string {
+	var errs []string
+	for _, msg := range path.IsValidPathSegmentName(rule.Name) {
+		errs = append(errs, fmt.Sprintf("invalid external metric name %q: %s", rule.Name, msg))
+	}
+	if err := config.CheckQuerySyntax(rule.Query); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid query for external metric %s: %v", rule.Name, err))
+	} else if err := rule.Validate(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	return errs
+}
+
+// collisions returns warnings for existing rules of the same name declaring a different query.
+func (v *hpaValidator) collisions(source ruleSource, rule config.MetricRule) []string {
+	entries := v.driver.getEntries(rule.Name)
+	namespaces := make([]string, 0, len(entries))
+	for namespace := range entries {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	var warnings []string
+	for _, namespace := range namespaces {
+		entry := entries[namespace]
+		if entry.rule.Query == rule.Query || ownedBy(entry, source) {
+			continue
+		}
+		switch namespace {
+		case "":
+			warnings = append(warnings, fmt.Sprintf("external metric %s shadows the cluster-wide rule declared by %s within namespace %s",
+				rule.Name, entry.owners[0], source.namespace))
+		case source.namespace:
+			warnings = append(warnings, fmt.Sprintf("external metric %s is already declared by %s with a different query, the query of the first declaration in order is served",
+				rule.Name, entry.owners[0]))
+		default:
+			warnings = append(warnings, fmt.Sprintf("external metric %s is declared by %s with a different query, rules are scoped to their namespace",
+				rule.Name, entry.owners[0]))
+		}
+	}
+	return warnings
+}
+
+// ownedBy returns true if the source is the only owner of the entry, the UID is ignored as it is not set on creation.
+func ownedBy(entry ruleEntry, source ruleSource) bool {
+	for _, owner := range entry.owners {
+		if owner.kind != source.kind || owner.namespace != source.namespace || owner.name != source.name {
+			return false
+		}
+	}
+	return len(entry.owners) > 0
+}
@@ -0,0 +1,118 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	v2 "k8s.io/api/autoscaling/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+func TestCheckQuerySyntax(t *testing.T) {
+	for _, query := range []string{
+		"ts(queue.depth)",
+		`mavg(5m, ts(queue.depth, queue="a(b" and env='prod'))`,
+		`ts(queue.depth, queue="${queue}") * 2`,
+		`sum(ts(a), [tag]) / ts("b\"c")`,
+	} {
+		assert.NoError(t, config.CheckQuerySyntax(query), query)
+	}
+	for _, query := range []string{
+		"",
+		"queue.depth",
+		"ts(queue.depth",
+		"ts(queue.depth))",
+		`ts(queue.depth, queue="a)`,
+		"sum(ts(a], b)",
+	} {
+		assert.Error(t, config.CheckQuerySyntax(query), query)
+	}
+}
+
+func TestValidateHPA(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	driver.setRules(ruleSource{kind: fileSourceKind, name: "config.yaml"}, []config.MetricRule{{Name: "shared", Query: "ts(shared)"}})
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "other", name: "hpa"}, []config.MetricRule{{Name: "queue_depth", Query: "ts(other.depth)"}})
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "default", name: "hpa"}, []config.MetricRule{{Name: "own", Query: "ts(own)"}})
+	validator := &hpaValidator{driver: driver}
+
+	hpa := externalHPA("default", "hpa", map[string]string{
+		"wavefront.com.external.metric/queue_depth": "ts(queue.depth)",
+		"wavefront.com.external.metric/shared":      "ts(other.shared)",
+		"wavefront.com.external.metric/own":         "ts(own.changed)",
+	}, "queue_depth", "shared", "own")
+	errs, warnings := validator.validate(hpa)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{
+		"external metric queue_depth is declared by HorizontalPodAutoscaler other/hpa with a different query, rules are scoped to their namespace",
+		"external metric shared shadows the cluster-wide rule declared by File config.yaml within namespace default",
+	}, warnings)
+
+	hpa = externalHPA("default", "hpa", map[string]string{
+		"wavefront.com.external.metricqueue_depth": "ts(queue.depth)",
+		"wavefront.com.external.metric/bad":        "ts(queue.depth",
+		"wavefront.com.external.metric/..":         "ts(queue.depth)",
+	}, "shared", "unknown")
+	errs, _ = validator.validate(hpa)
+	assert.Equal(t, []string{
+		`invalid external metric name "..": may not be '..'`,
+		"invalid query for external metric bad: unclosed '('",
+		"annotation wavefront.com.external.metricqueue_depth must be of the form wavefront.com.external.metric/<metric name>",
+		"external metric unknown is neither declared by a wavefront.com.external.metric/unknown annotation nor by a known rule",
+	}, errs)
+	// annotations cannot declare params, parameters are read from the metricSelector as when served
+	hpa = externalHPA("default", "hpa", map[string]string{
+		"wavefront.com.external.metric/queue_depth": `ts(queue.depth, queue="${queue}" and namespace="${namespace}")`,
+	}, "queue_depth")
+	errs, _ = validator.validate(hpa)
+	assert.Empty(t, errs)
+}
+
+func TestAdmissionHandler(t *testing.T) {
+	p := &wavefrontProvider{externalDriver: newWavefrontExternalDriver()}
+	raw, _ := json.Marshal(externalHPA("default", "hpa", nil, "unknown"))
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "1234",
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, _ := json.Marshal(review)
+
+	recorder := httptest.NewRecorder()
+	p.AdmissionHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, AdmissionWebhookPath, bytes.NewReader(body)))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+
+	var response admissionv1.AdmissionReview
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, "AdmissionReview", response.Kind)
+	assert.Equal(t, "1234", string(response.Response.UID))
+	assert.False(t, response.Response.Allowed)
+	assert.Contains(t, response.Response.Result.Message, "external metric unknown")
+}
+
+func externalHPA(namespace, name string, annotations map[string]string, metrics ...string) *v2.HorizontalPodAutoscaler {
+	hpa := &v2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+	}
+	for _, metric := range metrics {
+		hpa.Spec.Metrics = append(hpa.Spec.Metrics, v2.MetricSpec{
+			Type:     v2.ExternalMetricSourceType,
+			External: &v2.ExternalMetricSource{Metric: v2.MetricIdentifier{Name: metric}},
+		})
+	}
+	return hpa
+}
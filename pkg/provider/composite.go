@@ -0,0 +1,149 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// getCompositeMetric serves the value of a composite rule, evaluating its queries with the given parameters.
+func (p *wavefrontProvider) getCompositeMetric(namespace string, rule config.MetricRule, params map[string]string) (*external_metrics.ExternalMetricValueList, error) {
+	queries, err := expandQueries(rule, params)
+	if err != nil {
+		return nil, apierr.NewBadRequest(err.Error())
+	}
+
+	results, err := p.queryAll(queries, rule.QueryWindow())
+	if err != nil {
+		log.Errorf("unable to fetch metrics from wavefront: %v", err)
+		p.externalDriver.evaluated(namespace, rule.Name, nil, err)
+		// don't leak implementation details to the user
+		return nil, apierr.NewInternalError(fmt.Errorf("error fetching metrics for external metric: %s", rule.Name))
+	}
+	values, _, err := compositeValuesFor(results, rule)
+	if err != nil {
+		p.externalDriver.evaluated(namespace, rule.Name, nil, &wave.Error{Type: wave.ErrBadData, Msg: err.Error()})
+		return nil, err
+	}
+	p.externalDriver.evaluated(namespace, rule.Name, values, nil)
+	return values, nil
+}
+
+// queryAll runs the named queries concurrently over the window, failing if any of them fails.
+func (p *wavefrontProvider) queryAll(queries map[string]string, window time.Duration) (map[string]wave.QueryResult, error) {
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	results := make(map[string]wave.QueryResult, len(queries))
+	for name, query := range queries {
+		wg.Add(1)
+		go func(name, query string) {
+			defer wg.Done()
+			result, err := p.rawQuery(query, window)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("query %s: %v", name, err))
+				return
+			}
+			results[name] = result
+		}(name, query)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return results, nil
+}
+
+// compositeValuesFor combines the results of the queries of a composite rule through its expression.
+// Every series is transformed and reduced as for other rules, and the values of all series of a query are summed.
+// The rule falls back when an operand has no data or the expression has no valid value, such as on division by zero.
+// The value of each operand with data is returned along with the served values.
+func compositeValuesFor(results map[string]wave.QueryResult, rule config.MetricRule) (*external_metrics.ExternalMetricValueList, map[string]float64, error) {
+	expression, err := config.ParseExpression(rule.Expression)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid expression for external metric %s: %v", rule.Name, err)
+	}
+
+	operands := make(map[string]float64, len(results))
+	var missing []string
+	for _, name := range expression.Operands() {
+		value, found, err := operandValue(results[name], rule)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid data point for operand %s of external metric: %s", name, rule.Name)
+		}
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		operands[name] = value
+	}
+	sort.Strings(missing)
+
+	var value float64
+	switch {
+	case len(missing) == 0:
+		value = expression.Evaluate(operands)
+		if validValue(value) {
+			break
+		}
+		if rule.Fallback == nil {
+			return nil, operands, fmt.Errorf("invalid value %v of expression %s for external metric: %s", value, rule.Expression, rule.Name)
+		}
+		log.Debugf("invalid value %v for external metric: %s, using fallback: %f", value, rule.Name, *rule.Fallback)
+		value = *rule.Fallback
+	case rule.Fallback != nil:
+		log.Debugf("no data for operands %v of external metric: %s, using fallback: %f", missing, rule.Name, *rule.Fallback)
+		value = *rule.Fallback
+	default:
+		return nil, operands, fmt.Errorf("no data for operands %v of external metric: %s", missing, rule.Name)
+	}
+
+	served, err := externalValue(rule.Name, value, rule.Conversion)
+	if err != nil {
+		return nil, operands, fmt.Errorf("invalid value for external metric %s: %v", rule.Name, err)
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{served},
+	}, operands, nil
+}
+
+// operandValue returns the sum of the transformed and reduced values of all series with valid data.
+func operandValue(result wave.QueryResult, rule config.MetricRule) (float64, bool, error) {
+	var sum float64
+	found := false
+	for _, timeseries := range result.Timeseries {
+		data, err := transform(timeseries.Data, rule.Transforms)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		value, err := seriesValue(timeseries, data, rule)
+		if err != nil {
+			return 0, false, err
+		}
+		if !validValue(value) {
+			log.Warningf("ignoring invalid value %v of series %s", value, seriesKey(timeseries))
+			continue
+		}
+		sum += value
+		found = true
+	}
+	return sum, found, nil
+}
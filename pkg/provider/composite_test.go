@@ -0,0 +1,144 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+func TestExpressions(t *testing.T) {
+	values := map[string]float64{"backlog": 120, "throughput": 4, "zero": 0}
+	for expression, expected := range map[string]float64{
+		"backlog / throughput":              30,
+		"backlog / max(throughput, 10)":     12,
+		"min(backlog, throughput, 2) * 1.5": 3,
+		"-backlog + 2 * (throughput - 1)":   -114,
+		"backlog - throughput - 1":          115,
+		"backlog / throughput / 2":          15,
+		"1e2 + .5":                          100.5,
+		"-(-zero)":                          0,
+	} {
+		parsed, err := config.ParseExpression(expression)
+		if assert.NoError(t, err, expression) {
+			assert.Equal(t, expected, parsed.Evaluate(values), expression)
+		}
+	}
+
+	parsed, err := config.ParseExpression("max(b, a) / a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, parsed.Operands())
+	assert.True(t, math.IsInf(parsed.Evaluate(map[string]float64{"a": 0, "b": 1}), 1))
+
+	for expression, message := range map[string]string{
+		"":              "unexpected end of expression: ",
+		"a +":           "unexpected end of expression: a +",
+		"a b":           `unexpected "b" at position 3 in expression: a b`,
+		"(a + b":        "unexpected end of expression: (a + b",
+		"avg(a, b)":     `unknown function "avg" in expression: avg(a, b)`,
+		"a % b":         `unexpected "%" at position 3 in expression: a % b`,
+		"max()":         `unexpected ")" at position 5 in expression: max()`,
+		"1.2.3 * a":     `unexpected "1.2.3" at position 1 in expression: 1.2.3 * a`,
+		"max(a, b) c()": `unexpected "c" at position 11 in expression: max(a, b) c()`,
+	} {
+		_, err := config.ParseExpression(expression)
+		assert.EqualError(t, err, message, expression)
+	}
+}
+
+func TestValidateCompositeRules(t *testing.T) {
+	rule := func(query, expression string, queries map[string]string) config.MetricRule {
+		return config.MetricRule{Name: "ratio", Query: query, Expression: expression, Queries: queries}
+	}
+	assert.NoError(t, rule("", "a / b", map[string]string{"a": "ts(a)", "b": "ts(b)"}).Validate())
+	assert.EqualError(t, rule("ts(a)", "a", map[string]string{"a": "ts(a)"}).Validate(),
+		"only one of query and queries can be specified for rule: ratio")
+	assert.EqualError(t, rule("", "", map[string]string{"a": "ts(a)"}).Validate(),
+		"missing expression for rule: ratio")
+	assert.EqualError(t, rule("", "a / b", map[string]string{"a": "ts(a)"}).Validate(),
+		`missing query for operand "b" of rule: ratio`)
+	assert.EqualError(t, rule("", "a", map[string]string{"a": "ts(a)", "b": "ts(b)"}).Validate(),
+		`query "b" is not referenced by the expression of rule: ratio`)
+	assert.EqualError(t, rule("", "a +", map[string]string{"a": "ts(a)"}).Validate(),
+		"unexpected end of expression: a + for rule: ratio")
+	assert.EqualError(t, rule("", "a", map[string]string{"a": `ts(a, q="${queue}")`}).Validate(),
+		`undeclared parameter "queue" in query for rule: ratio`)
+}
+
+func TestCompositeValues(t *testing.T) {
+	results := map[string]client.QueryResult{
+		"backlog":    {Timeseries: []client.Timeseries{valueSeries("a", 100), valueSeries("b", 20)}},
+		"throughput": {Timeseries: []client.Timeseries{valueSeries("a", 4), valueSeries("b", math.NaN())}},
+		"empty":      {},
+		"zero":       {Timeseries: []client.Timeseries{valueSeries("a", 0)}},
+	}
+	rule := config.MetricRule{Name: "ratio", Expression: "backlog / throughput"}
+
+	// the values of all series of an operand are summed, invalid values are ignored
+	values, operands, err := compositeValuesFor(results, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]float64{"backlog": 120, "throughput": 4}, operands)
+	assert.Equal(t, "ratio", values.Items[0].MetricName)
+	assert.Equal(t, "30", values.Items[0].Value.String())
+
+	rule.Expression = "backlog / empty + throughput / missing"
+	_, _, err = compositeValuesFor(results, rule)
+	assert.EqualError(t, err, "no data for operands [empty missing] of external metric: ratio")
+
+	rule.Expression = "backlog / zero"
+	_, _, err = compositeValuesFor(results, rule)
+	assert.EqualError(t, err, "invalid value +Inf of expression backlog / zero for external metric: ratio")
+
+	fallback := 1.0
+	rule.Fallback = &fallback
+	for _, expression := range []string{"backlog / zero", "backlog / empty"} {
+		rule.Expression = expression
+		values, _, err = compositeValuesFor(results, rule)
+		assert.NoError(t, err, expression)
+		assert.Equal(t, "1", values.Items[0].Value.String(), expression)
+	}
+}
+
+func TestGetCompositeMetric(t *testing.T) {
+	waveClient := &seriesClient{series: map[string][]client.Timeseries{
+		"sqs.backlog":    {valueSeries("orders", 90)},
+		"sqs.throughput": {valueSeries("orders", 30)},
+	}}
+	driver := newWavefrontExternalDriver()
+	driver.setRules(ruleSource{kind: fileSourceKind}, []config.MetricRule{{
+		Name: "backlog_per_consumer",
+		Queries: map[string]string{
+			"backlog":    `ts(sqs.backlog, QueueName="${queue}")`,
+			"throughput": `ts(sqs.throughput, QueueName="${queue}")`,
+		},
+		Expression: "backlog / max(throughput, 1)",
+		Params:     []string{"queue"},
+	}})
+	p := &wavefrontProvider{waveClient: waveClient, externalDriver: driver, Translator: NewWavefrontTranslator("kubernetes")}
+	info := provider.ExternalMetricInfo{Metric: "backlog_per_consumer"}
+
+	values, err := p.GetExternalMetric(context.Background(), "default", labels.SelectorFromSet(labels.Set{"queue": "orders"}), info)
+	assert.NoError(t, err)
+	assert.Equal(t, "3", values.Items[0].Value.String())
+	assert.ElementsMatch(t, []string{`ts(sqs.backlog, QueueName="orders")`, `ts(sqs.throughput, QueueName="orders")`}, waveClient.queries)
+
+	_, err = p.GetExternalMetric(context.Background(), "default", labels.Everything(), info)
+	assert.EqualError(t, err, "missing required parameters [queue] for external metric backlog_per_consumer, provide them as metricSelector labels")
+
+	explanation, err := p.ExplainExternalMetric("default", labels.SelectorFromSet(labels.Set{"queue": "orders"}), info)
+	assert.NoError(t, err)
+	assert.Equal(t, "backlog / max(throughput, 1)", explanation.Query)
+	assert.Equal(t, map[string]float64{"backlog": 90, "throughput": 30}, explanation.Matched)
+	assert.Equal(t, "backlog", explanation.Operands[0].Name)
+	assert.Equal(t, `ts(sqs.throughput, QueueName="orders")`, explanation.Operands[1].Query)
+}
@@ -0,0 +1,164 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+const (
+	// configPollInterval is used to poll the config file when it cannot be watched
+	configPollInterval = 1 * time.Minute
+
+	defaultConfigMapKey = "config.yaml"
+)
+
+// watchConfigFile reloads the config file whenever it changes, until stopCh is closed.
+// The directory is watched rather than the file since config maps mounted
+// as volumes are updated by atomically swapping symlinks.
+func (d *WavefrontExternalDriver) watchConfigFile(stopCh <-chan struct{}) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("unable to watch external config file, polling instead: %v", err)
+		d.pollConfigFile(stopCh)
+		return
+	}
+	defer watcher.Close()
+
+	dir := filepath.Dir(d.cfgFile)
+	if err := watcher.Add(dir); err != nil {
+		log.Errorf("unable to watch external config directory %s, polling instead: %v", dir, err)
+		d.pollConfigFile(stopCh)
+		return
+	}
+	log.Infof("watching external config file %s", d.cfgFile)
+
+	for {
+		select {
+		case <-stopCh:
+			log.Infof("stopped watching external config file %s", d.cfgFile)
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			log.Debugf("external config directory changed: %s", event)
+			d.reloadConfig()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("error watching external config file: %v", err)
+		}
+	}
+}
+
+func (d *WavefrontExternalDriver) pollConfigFile(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		d.reloadConfig()
+	}, configPollInterval, stopCh)
+}
+
+// configMapRef identifies a key within a config map.
+type configMapRef struct {
+	namespace string
+	name      string
+	key       string
+}
+
+func (r configMapRef) String() string {
+	return fmt.Sprintf("%s/%s/%s", r.namespace, r.name, r.key)
+}
+
+// parseConfigMapRef parses references of the form namespace/name[/key], the key defaults to config.yaml.
+func parseConfigMapRef(s string) (configMapRef, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return configMapRef{}, fmt.Errorf("expected namespace/name[/key], got: %q", s)
+	}
+	ref := configMapRef{namespace: parts[0], name: parts[1], key: defaultConfigMapKey}
+	if len(parts) == 3 && parts[2] != "" {
+		ref.key = parts[2]
+	}
+	return ref, nil
+}
+
+// loadConfigMap loads the configuration from the config map and applies every later change immediately.
+func (d *WavefrontExternalDriver) loadConfigMap(client kubernetes.Interface, ref configMapRef, failOnInvalidCfg bool, stopCh <-chan struct{}) {
+	cm, err := client.CoreV1().ConfigMaps(ref.namespace).Get(context.Background(), ref.name, metav1.GetOptions{})
+	if err == nil {
+		err = d.applyConfigMap(ref, cm)
+	} else {
+		err = fmt.Errorf("unable to get external config map %s: %v", ref, err)
+		d.configFailed(err)
+	}
+	if err != nil && failOnInvalidCfg {
+		log.Fatalf("unable to load external metrics discovery configuration: %v", err)
+	}
+	go d.watchConfigMap(client, ref, stopCh)
+}
+
+func (d *WavefrontExternalDriver) watchConfigMap(client kubernetes.Interface, ref configMapRef, stopCh <-chan struct{}) {
+	log.Infof("watching external config map %s", ref)
+
+	rc := client.CoreV1().RESTClient()
+	lw := cache.NewListWatchFromClient(rc, "configmaps", ref.namespace, fields.OneTermEqualSelector("metadata.name", ref.name))
+	inf := cache.NewSharedInformer(lw, &v1.ConfigMap{}, 0)
+
+	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			d.applyConfigMap(ref, obj.(*v1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCM := oldObj.(*v1.ConfigMap)
+			newCM := newObj.(*v1.ConfigMap)
+			if oldCM.Data[ref.key] == newCM.Data[ref.key] {
+				return
+			}
+			d.applyConfigMap(ref, newCM)
+		},
+		DeleteFunc: func(obj interface{}) {
+			d.configFailed(fmt.Errorf("external config map %s was deleted", ref))
+		},
+	})
+	inf.Run(stopCh)
+}
+
+// applyConfigMap applies the configuration within the config map.
+// On failure the last valid rules are kept and the error is recorded until the config map changes again.
+func (d *WavefrontExternalDriver) applyConfigMap(ref configMapRef, cm *v1.ConfigMap) error {
+	contents, found := cm.Data[ref.key]
+	if !found {
+		err := fmt.Errorf("key %s not found in external config map %s/%s", ref.key, ref.namespace, ref.name)
+		d.configFailed(err)
+		return err
+	}
+	metricsConfig, err := config.FromYAML([]byte(contents))
+	if err != nil {
+		d.configFailed(err)
+		return err
+	}
+	d.configLoaded()
+	source := ruleSource{kind: configMapSourceKind, name: ref.String()}
+	d.setRules(source, metricsConfig.Rules)
+	d.setPatterns(source, metricsConfig.Patterns)
+	d.setCustomMetrics(metricsConfig.CustomMetrics)
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestParseConfigMapRef(t *testing.T) {
+	ref, err := parseConfigMapRef("custom-metrics/adapter-config")
+	assert.NoError(t, err)
+	assert.Equal(t, configMapRef{namespace: "custom-metrics", name: "adapter-config", key: "config.yaml"}, ref)
+
+	ref, err = parseConfigMapRef("custom-metrics/adapter-config/rules.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "rules.yaml", ref.key)
+
+	for _, invalid := range []string{"", "adapter-config", "/adapter-config", "a/b/c/d"} {
+		_, err = parseConfigMapRef(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestApplyConfigMapKeepsLastValidRules(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	ref := configMapRef{namespace: "custom-metrics", name: "adapter-config", key: "config.yaml"}
+	cm := func(contents string) *v1.ConfigMap {
+		return &v1.ConfigMap{Data: map[string]string{"config.yaml": contents}}
+	}
+
+	assert.NoError(t, driver.applyConfigMap(ref, cm("rules:\n- name: queue_depth\n  query: ts(queue.depth)\n")))
+	assert.Equal(t, "ts(queue.depth)", queryOf(driver, "default", "queue_depth"))
+
+	assert.Error(t, driver.applyConfigMap(ref, cm("rules: [\n")))
+	assert.Error(t, driver.applyConfigMap(ref, &v1.ConfigMap{}))
+	assert.Equal(t, "ts(queue.depth)", queryOf(driver, "default", "queue_depth"))
+
+	assert.NoError(t, driver.applyConfigMap(ref, cm("rules: []\n")))
+	assert.Equal(t, "", queryOf(driver, "default", "queue_depth"))
+}
+
+func TestWatchConfigFileStops(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, cfgFile, "rules:\n- name: queue_depth\n  query: ts(queue.depth)\n", time.Now())
+
+	driver := newWavefrontExternalDriver()
+	driver.cfgFile = cfgFile
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		driver.watchConfigFile(stopCh)
+		close(done)
+	}()
+
+	// changes are picked up while watching
+	assert.Eventually(t, func() bool {
+		writeConfig(t, cfgFile, "rules:\n- name: queue_depth\n  query: ts(other.depth)\n", time.Now().Add(time.Minute))
+		return queryOf(driver, "", "queue_depth") == "ts(other.depth)"
+	}, 5*time.Second, 50*time.Millisecond)
+
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("config file watch did not stop")
+	}
+}
+
+func TestConcurrentConfigSources(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	driver := newWavefrontExternalDriver()
+	driver.cfgFile = cfgFile
+	ref := configMapRef{namespace: "custom-metrics", name: "adapter-config", key: "config.yaml"}
+
+	// the file watch and the config map informer record the state of the configuration concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			writeConfig(t, cfgFile, "rules: []\n", time.Now().Add(time.Duration(i)*time.Minute))
+			driver.reloadConfig()
+		}(i)
+		go func() {
+			defer wg.Done()
+			driver.applyConfigMap(ref, &v1.ConfigMap{})
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,269 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/apis/v1alpha1"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// crdStatusInterval is the minimum interval between two status updates of an unchanged WavefrontExternalMetric
+const crdStatusInterval = 30 * time.Second
+
+type crdListener struct {
+	dynClient dynamic.Interface
+	setFunc   RuleHandlerFunc
+	status    *crdStatusWriter
+	stopCh    <-chan struct{}
+}
+
+// StartCRDListener sources external metric rules from WavefrontExternalMetric objects until stopCh is closed.
+// The returned function reports whether every object has been listed.
+func StartCRDListener(client dynamic.Interface, setFunc RuleHandlerFunc, status *crdStatusWriter, stopCh <-chan struct{}) cache.InformerSynced {
+	listener := &crdListener{
+		dynClient: client,
+		setFunc:   setFunc,
+		status:    status,
+		stopCh:    stopCh,
+	}
+	return listener.listen()
+}
+
+func (l *crdListener) listen() cache.InformerSynced {
+	log.Info("listening for WavefrontExternalMetric instances")
+
+	resource := l.dynClient.Resource(v1alpha1.WavefrontExternalMetricResource).Namespace(v1.NamespaceAll)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return resource.List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return resource.Watch(context.Background(), options)
+		},
+	}
+	inf := cache.NewSharedInformer(lw, &unstructured.Unstructured{}, 0)
+
+	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			l.apply(obj.(*unstructured.Unstructured))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldMetric := oldObj.(*unstructured.Unstructured)
+			newMetric := newObj.(*unstructured.Unstructured)
+
+			// status updates do not change the generation
+			if oldMetric.GetGeneration() == newMetric.GetGeneration() {
+				return
+			}
+			l.apply(newMetric)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			metric, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				log.Errorf("unexpected object deleted: %T", obj)
+				return
+			}
+			source := crdSource(metric)
+			l.setFunc(source, nil)
+			l.status.forget(source)
+		},
+	})
+	go inf.Run(l.stopCh)
+	return inf.HasSynced
+}
+
+func (l *crdListener) apply(obj *unstructured.Unstructured) {
+	source := crdSource(obj)
+	rule, err := ruleFromCRD(obj)
+	if err != nil {
+		log.Errorf("invalid %s: %v", source, err)
+		l.setFunc(source, nil)
+		l.status.update(source, nil, err)
+		return
+	}
+	l.setFunc(source, []config.MetricRule{rule})
+}
+
+func crdSource(obj *unstructured.Unstructured) ruleSource {
+	return ruleSource{
+		kind:      crdSourceKind,
+		namespace: obj.GetNamespace(),
+		name:      obj.GetName(),
+		uid:       obj.GetUID(),
+	}
+}
+
+func ruleFromCRD(obj *unstructured.Unstructured) (config.MetricRule, error) {
+	var metric v1alpha1.WavefrontExternalMetric
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &metric); err != nil {
+		return config.MetricRule{}, err
+	}
+
+	rule := config.MetricRule{
+		Name:      metric.Spec.MetricName,
+		Query:     metric.Spec.Query,
+		Reduction: metric.Spec.Reduction,
+		Fallback:  metric.Spec.Fallback,
+		Params:    metric.Spec.Params,
+		Conversion: config.Conversion{
+			Scale: metric.Spec.Scale,
+			Unit:  metric.Spec.Unit,
+		},
+	}
+	if rule.Name == "" {
+		rule.Name = metric.Name
+	}
+	if metric.Spec.Window != nil {
+		rule.Window = config.Duration(metric.Spec.Window.Duration)
+	}
+	return rule, rule.Validate()
+}
+
+// crdStatusWriter reports the outcome of evaluations on the status of WavefrontExternalMetric objects.
+// Statuses are patched one at a time, and only the latest status of an object waiting to be patched is kept.
+type crdStatusWriter struct {
+	dynClient dynamic.Interface
+	queue     workqueue.Interface
+	lock      sync.Mutex
+	reported  map[ruleSource]crdStatusReport
+	pending   map[ruleSource]v1alpha1.WavefrontExternalMetricStatus
+}
+
+type crdStatusReport struct {
+	time      time.Time
+	lastError string
+}
+
+// newCRDStatusWriter returns a writer patching statuses until stopCh is closed.
+func newCRDStatusWriter(client dynamic.Interface, stopCh <-chan struct{}) *crdStatusWriter {
+	w := &crdStatusWriter{
+		dynClient: client,
+		queue:     workqueue.New(),
+		reported:  make(map[ruleSource]crdStatusReport),
+		pending:   make(map[ruleSource]v1alpha1.WavefrontExternalMetricStatus),
+	}
+	go w.run()
+	go func() {
+		<-stopCh
+		w.queue.ShutDown()
+	}()
+	return w
+}
+
+// update patches the status of the object unless an identical outcome was reported recently.
+func (w *crdStatusWriter) update(source ruleSource, values *external_metrics.ExternalMetricValueList, err error) {
+	if w == nil {
+		return
+	}
+	now := time.Now()
+	status := v1alpha1.WavefrontExternalMetricStatus{
+		LastEvaluationTime: &metav1.Time{Time: now},
+	}
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	if values != nil {
+		quantities := make([]string, len(values.Items))
+		for i, value := range values.Items {
+			quantities[i] = value.Value.String()
+		}
+		status.LastValue = strings.Join(quantities, ",")
+	}
+
+	w.lock.Lock()
+	previous, found := w.reported[source]
+	if found && previous.lastError == status.LastError && now.Sub(previous.time) < crdStatusInterval {
+		w.lock.Unlock()
+		return
+	}
+	w.reported[source] = crdStatusReport{time: now, lastError: status.LastError}
+	w.pending[source] = status
+	w.lock.Unlock()
+
+	// the queue holds an object at most once, however often it is updated before being patched
+	w.queue.Add(source)
+}
+
+func (w *crdStatusWriter) forget(source ruleSource) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.reported, source)
+	delete(w.pending, source)
+}
+
+func (w *crdStatusWriter) run() {
+	for w.patchNext() {
+	}
+}
+
+// patchNext patches the latest status of the next queued object, returning false once the queue is shut down.
+func (w *crdStatusWriter) patchNext() bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer w.queue.Done(item)
+
+	source := item.(ruleSource)
+	w.lock.Lock()
+	status, found := w.pending[source]
+	delete(w.pending, source)
+	w.lock.Unlock()
+	if found {
+		w.patch(source, status)
+	}
+	return true
+}
+
+func (w *crdStatusWriter) patch(source ruleSource, status v1alpha1.WavefrontExternalMetricStatus) {
+	// explicit nulls clear fields left over from previous evaluations
+	data, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"lastEvaluationTime": status.LastEvaluationTime,
+			"lastValue":          nullIfEmpty(status.LastValue),
+			"lastError":          nullIfEmpty(status.LastError),
+		},
+	})
+	if err != nil {
+		log.Errorf("unable to encode status of %s: %v", source, err)
+		return
+	}
+	_, err = w.dynClient.Resource(v1alpha1.WavefrontExternalMetricResource).Namespace(source.namespace).
+		Patch(context.Background(), source.name, types.MergePatchType, data, metav1.PatchOptions{}, "status")
+	if err != nil {
+		log.Errorf("unable to update status of %s: %v", source, err)
+	}
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRuleFromCRD(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "wavefront.com/v1alpha1",
+		"kind":       "WavefrontExternalMetric",
+		"metadata": map[string]interface{}{
+			"name":      "queue-depth",
+			"namespace": "default",
+		},
+		"spec": map[string]interface{}{
+			"query":     "ts(queue.depth)",
+			"window":    "5m",
+			"reduction": "avg",
+			"fallback":  float64(0),
+			"scale":     float64(1024),
+			"unit":      "bytes",
+		},
+	}}
+
+	rule, err := ruleFromCRD(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, "queue-depth", rule.Name)
+	assert.Equal(t, "ts(queue.depth)", rule.Query)
+	assert.Equal(t, config.Duration(5*time.Minute), rule.Window)
+	assert.Equal(t, config.ReductionAvg, rule.Reduction)
+	assert.Equal(t, 0.0, *rule.Fallback)
+	assert.Equal(t, config.Conversion{Scale: 1024, Unit: config.UnitBytes}, rule.Conversion)
+
+	unstructured.SetNestedField(obj.Object, "queue_depth", "spec", "metricName")
+	unstructured.SetNestedField(obj.Object, "median", "spec", "reduction")
+	rule, err = ruleFromCRD(obj)
+	assert.Equal(t, "queue_depth", rule.Name)
+	assert.Error(t, err)
+}
+
+func TestCRDStatusCoalesced(t *testing.T) {
+	patches := make(chan string)
+	release := make(chan struct{})
+	dynClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynClient.PrependReactor("patch", "wavefrontexternalmetrics", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches <- string(action.(k8stesting.PatchAction).GetPatch())
+		<-release
+		return true, &unstructured.Unstructured{}, nil
+	})
+	writer := newCRDStatusWriter(dynClient, wait.NeverStop)
+	source := ruleSource{kind: crdSourceKind, namespace: "default", name: "queue-depth"}
+
+	writer.update(source, nil, errors.New("first"))
+	assert.Contains(t, <-patches, "first")
+	// updates made while a patch is in flight are coalesced into a single patch of the latest status
+	writer.update(source, nil, errors.New("second"))
+	writer.update(source, nil, errors.New("third"))
+	close(release)
+	assert.Contains(t, <-patches, "third")
+
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	assert.Empty(t, writer.pending)
+	assert.Zero(t, writer.queue.Len())
+}
@@ -0,0 +1,264 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// QueryExplainer evaluates metrics exactly as the adapter would serve them,
+// while recording every intermediate step of the evaluation.
+type QueryExplainer interface {
+	ExplainCustomMetric(namespace string, selector labels.Selector, info provider.CustomMetricInfo) (*QueryExplanation, error)
+	ExplainExternalMetric(namespace string, selector labels.Selector, info provider.ExternalMetricInfo) (*QueryExplanation, error)
+}
+
+// QueryExplanation describes how a single metric request was evaluated.
+type QueryExplanation struct {
+	Metric    string             `json:"metric"`
+	Namespace string             `json:"namespace,omitempty"`
+	Names     []string           `json:"names,omitempty"`
+	Query     string             `json:"query"`
+	Result    wave.QueryResult   `json:"result"`
+	Matched   map[string]float64 `json:"matched"`
+	Served    []ServedValue      `json:"served"`
+	// Operands holds the queries of a composite rule, whose Query is the expression and Matched the value of each operand
+	Operands []OperandExplanation `json:"operands,omitempty"`
+}
+
+// OperandExplanation describes the evaluation of a single query of a composite rule.
+type OperandExplanation struct {
+	Name   string           `json:"name"`
+	Query  string           `json:"query"`
+	Result wave.QueryResult `json:"result"`
+}
+
+// ServedValue is a single value as it would be returned by the metrics API.
+type ServedValue struct {
+	Name     string            `json:"name"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Quantity string            `json:"quantity"`
+}
+
+// NewQueryExplainer returns a QueryExplainer backed by the given external metric rules keyed by namespace
+// and the given patterns. The empty namespace holds the cluster-wide rules. Unlike NewWavefrontProvider it does not start any background discovery.
+// With a KubeClient, namespaces are listed to check namespace selectors of rules, otherwise they never match.
+// With a custom metrics configuration, custom metrics are listed once and resolved as the adapter would expose them.
+func NewQueryExplainer(cfg WavefrontProviderConfig, rules map[string][]config.MetricRule, patterns []config.PatternRule,
+	customMetrics *config.CustomMetricsConfig) QueryExplainer {
+	driver := newWavefrontExternalDriver()
+	driver.setCustomMetrics(customMetrics)
+	if cfg.KubeClient != nil {
+		driver.namespaces = newNamespaceWatcher(cfg.KubeClient, wait.NeverStop)
+	}
+	for namespace, namespaceRules := range rules {
+		driver.setRules(ruleSource{kind: fileSourceKind, namespace: namespace}, namespaceRules)
+	}
+	driver.setPatterns(ruleSource{kind: fileSourceKind}, patterns)
+	if !waitForSync(driver.hasSynced, namespaceSyncTimeout) {
+		log.Warningf("namespaces have not been listed within %s", namespaceSyncTimeout)
+	}
+
+	var lister MetricsLister
+	if customMetrics != nil {
+		metricsLister := &WavefrontMetricsLister{
+			Prefix:         cfg.Prefix,
+			waveClient:     cfg.WaveClient,
+			externalDriver: driver,
+			Translator:     NewWavefrontTranslator(cfg.Prefix),
+		}
+		if err := metricsLister.updateCustomMetrics(); err != nil {
+			log.Warningf("unable to list custom metrics, only metrics that are neither renamed nor filtered resolve: %v", err)
+		}
+		lister = metricsLister
+	}
+
+	return &wavefrontProvider{
+		dynClient:      cfg.DynClient,
+		mapper:         cfg.Mapper,
+		waveClient:     cfg.WaveClient,
+		lister:         lister,
+		externalDriver: driver,
+		clusterName:    cfg.ClusterName,
+		prefix:         cfg.Prefix,
+		Translator:     NewWavefrontTranslator(cfg.Prefix),
+	}
+}
+
+// RulesFromHPAs returns the external metric rules declared through annotations
+// on the HPAs in the given namespace, keyed by the namespace of each HPA.
+func RulesFromHPAs(client kubernetes.Interface, namespace string) (map[string][]config.MetricRule, error) {
+	hpas, err := client.AutoscalingV2().HorizontalPodAutoscalers(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	rules := make(map[string][]config.MetricRule)
+	for _, hpa := range hpas.Items {
+		rules[hpa.Namespace] = append(rules[hpa.Namespace], rulesFromAnnotations(hpa.Annotations)...)
+	}
+	return rules, nil
+}
+
+func (p *wavefrontProvider) ExplainCustomMetric(namespace string, selector labels.Selector, info provider.CustomMetricInfo) (*QueryExplanation, error) {
+	names, err := helpers.ListObjectNames(p.mapper, p.dynClient, namespace, selector, info)
+	if err != nil {
+		return nil, err
+	}
+	explanation := &QueryExplanation{
+		Metric:    info.String(),
+		Namespace: namespace,
+		Names:     names,
+	}
+
+	source, found := p.customSourceFor(info)
+	if !found {
+		return explanation, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	resType := resourceType(info.GroupResource.Resource)
+	query := source.query(resType, namespace, names...)
+	explanation.Query = query
+
+	explanation.Result, err = p.rawQuery(query, 0)
+	if err != nil {
+		return explanation, err
+	}
+
+	values, found := matchValuesToNames(explanation.Result, source.nameTag(resType))
+	if !found {
+		return explanation, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	explanation.Matched = values
+
+	invalid := invalidNames(explanation.Result, source.nameTag(resType))
+	for _, name := range names {
+		value, found := values[name]
+		if !found && invalid[name] {
+			continue
+		}
+		metric, err := p.metricFor(value, types.NamespacedName{Namespace: namespace, Name: name}, info, source.Conversion)
+		if err != nil {
+			return explanation, err
+		}
+		explanation.Served = append(explanation.Served, ServedValue{
+			Name:     name,
+			Quantity: metric.Value.String(),
+		})
+	}
+	return explanation, nil
+}
+
+func (p *wavefrontProvider) ExplainExternalMetric(namespace string, selector labels.Selector, info provider.ExternalMetricInfo) (*QueryExplanation, error) {
+	explanation := &QueryExplanation{
+		Metric:    info.Metric,
+		Namespace: namespace,
+	}
+
+	rule, found := p.externalDriver.getRule(namespace, info.Metric)
+	if !found {
+		return explanation, apierr.NewNotFound(external_metrics.Resource(info.Metric), info.Metric)
+	}
+	// the adapter would reject the request without querying Wavefront
+	if err := p.checkAccess(namespace, rule); err != nil {
+		return explanation, err
+	}
+	params := requestParams(namespace, p.clusterName, selector)
+	if rule.Composite() {
+		return p.explainComposite(explanation, rule, params)
+	}
+	query, err := expandQuery(rule, params)
+	if err != nil {
+		return explanation, err
+	}
+	explanation.Query = query
+
+	explanation.Result, err = p.rawQuery(query, rule.QueryWindow())
+	if err != nil {
+		return explanation, err
+	}
+
+	explanation.Matched = make(map[string]float64, len(explanation.Result.Timeseries))
+	for _, timeseries := range explanation.Result.Timeseries {
+		if length := len(timeseries.Data); length > 0 && len(timeseries.Data[length-1]) == 2 && validValue(timeseries.Data[length-1][1]) {
+			explanation.Matched[seriesKey(timeseries)] = timeseries.Data[length-1][1]
+		}
+	}
+
+	values, err := p.ExternalValuesFor(explanation.Result, rule)
+	if err != nil {
+		return explanation, err
+	}
+	for _, value := range values.Items {
+		explanation.Served = append(explanation.Served, ServedValue{
+			Name:     value.MetricName,
+			Labels:   value.MetricLabels,
+			Quantity: value.Value.String(),
+		})
+	}
+	return explanation, nil
+}
+
+func (p *wavefrontProvider) explainComposite(explanation *QueryExplanation, rule config.MetricRule, params map[string]string) (*QueryExplanation, error) {
+	explanation.Query = rule.Expression
+	queries, err := expandQueries(rule, params)
+	if err != nil {
+		return explanation, err
+	}
+	results, err := p.queryAll(queries, rule.QueryWindow())
+	if err != nil {
+		return explanation, err
+	}
+	for name, query := range queries {
+		explanation.Operands = append(explanation.Operands, OperandExplanation{Name: name, Query: query, Result: results[name]})
+	}
+	sort.Slice(explanation.Operands, func(i, j int) bool {
+		return explanation.Operands[i].Name < explanation.Operands[j].Name
+	})
+
+	values, operands, err := compositeValuesFor(results, rule)
+	explanation.Matched = operands
+	if err != nil {
+		return explanation, err
+	}
+	for _, value := range values.Items {
+		explanation.Served = append(explanation.Served, ServedValue{
+			Name:     value.MetricName,
+			Quantity: value.Value.String(),
+		})
+	}
+	return explanation, nil
+}
+
+// seriesKey identifies a time series by its label and sorted tags, e.g. 'cpu.usage{pod_name="pod1"}'
+func seriesKey(timeseries wave.Timeseries) string {
+	keys := make([]string, 0, len(timeseries.Tags))
+	for k := range timeseries.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tags := make([]string, len(keys))
+	for i, k := range keys {
+		tags[i] = fmt.Sprintf("%s=%q", k, timeseries.Tags[k])
+	}
+	return fmt.Sprintf("%s{%s}", timeseries.Label, strings.Join(tags, ","))
+}
@@ -0,0 +1,74 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+func TestExplainExternalMetric(t *testing.T) {
+	explainer := NewQueryExplainer(WavefrontProviderConfig{
+		WaveClient: client.NewFakeWavefrontClient(),
+		Prefix:     "kubernetes",
+	}, map[string][]config.MetricRule{"": {{Name: "queue_depth", Query: "ts(queue.depth)"}}}, nil, nil)
+
+	explanation, err := explainer.ExplainExternalMetric("default", labels.Everything(), provider.ExternalMetricInfo{Metric: "queue_depth"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ts(queue.depth)", explanation.Query)
+	assert.Len(t, explanation.Result.Timeseries, 5)
+	assert.Len(t, explanation.Matched, 5)
+	assert.Len(t, explanation.Served, 5)
+	assert.Equal(t, "2360m", explanation.Served[0].Quantity)
+
+	_, err = explainer.ExplainExternalMetric("default", labels.Everything(), provider.ExternalMetricInfo{Metric: "missing"})
+	assert.Error(t, err)
+}
+
+func TestExplainRenamedCustomMetric(t *testing.T) {
+	pods := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	mapper := apimeta.NewDefaultRESTMapper(nil)
+	mapper.Add(pods.GroupVersion().WithKind("Pod"), apimeta.RESTScopeNamespace)
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "test-deployment-7f54684694-2cg5v", "namespace": "default"},
+	}}
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{pods: "PodList"}, pod)
+
+	explainer := NewQueryExplainer(WavefrontProviderConfig{
+		WaveClient: client.NewFakeWavefrontClient(),
+		Prefix:     "kubernetes",
+		DynClient:  dynClient,
+		Mapper:     mapper,
+	}, nil, nil, &config.CustomMetricsConfig{
+		Renames: []config.MetricRename{{Resource: "pods", Match: `cpu\.usage_rate`, As: "cpu_usage"}},
+		Conversions: []config.MetricConversion{
+			{Resource: "pods", Match: `cpu\.usage_rate`, Conversion: config.Conversion{Scale: 1000}},
+		},
+	})
+
+	// the renamed metric is queried from the metric it is exposed for, and converted as served
+	info := CustomMetricInfoFor("pods", "cpu_usage")
+	explanation, err := explainer.ExplainCustomMetric("default", labels.Everything(), info)
+	assert.NoError(t, err)
+	assert.Contains(t, explanation.Query, "kubernetes.pod.cpu.usage_rate")
+	assert.Equal(t, []string{"test-deployment-7f54684694-2cg5v"}, explanation.Names)
+	assert.Equal(t, "2359800m", explanation.Served[0].Quantity)
+
+	// renamed metrics are not served under their original name
+	_, err = explainer.ExplainCustomMetric("default", labels.Everything(), CustomMetricInfoFor("pods", "cpu.usage_rate"))
+	assert.Error(t, err)
+}
@@ -4,125 +4,688 @@
 package provider
 
 import (
+	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/apis/v1alpha1"
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
 	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 
-	"k8s.io/apimachinery/pkg/util/wait"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
-type RuleHandlerFunc func([]config.MetricRule)
+// RuleHandlerFunc replaces the rules owned by a source. No rules means the source is gone.
+type RuleHandlerFunc func(source ruleSource, rules []config.MetricRule)
+
+// evaluationFailureThreshold is the number of consecutive evaluation failures after which owners are notified
+const evaluationFailureThreshold = 3
+
+const (
+	fileSourceKind      = "File"
+	configMapSourceKind = "ConfigMap"
+	hpaSourceKind       = "HorizontalPodAutoscaler"
+	crdSourceKind       = v1alpha1.WavefrontExternalMetricKind
+)
+
+// ruleSource identifies where a set of rules came from, such as the config file or an HPA.
+type ruleSource struct {
+	kind      string
+	namespace string
+	name      string
+	uid       types.UID
+}
+
+func (s ruleSource) String() string {
+	if s.namespace == "" {
+		return fmt.Sprintf("%s %s", s.kind, s.name)
+	}
+	return fmt.Sprintf("%s %s/%s", s.kind, s.namespace, s.name)
+}
+
+// isConfig returns whether the rules come from the adapter configuration, either a file or a config map.
+func (s ruleSource) isConfig() bool {
+	return s.kind == fileSourceKind || s.kind == configMapSourceKind
+}
+
+// objectRef returns a reference to the object declaring the rules, or nil for the config file.
+func (s ruleSource) objectRef() *v1.ObjectReference {
+	switch s.kind {
+	case hpaSourceKind:
+		return &v1.ObjectReference{
+			Kind:       s.kind,
+			APIVersion: "autoscaling/v2",
+			Namespace:  s.namespace,
+			Name:       s.name,
+			UID:        s.uid,
+		}
+	case crdSourceKind:
+		return &v1.ObjectReference{
+			Kind:       s.kind,
+			APIVersion: v1alpha1.SchemeGroupVersion.String(),
+			Namespace:  s.namespace,
+			Name:       s.name,
+			UID:        s.uid,
+		}
+	}
+	if resource, found := workloadResources[s.kind]; found {
+		return &v1.ObjectReference{
+			Kind:       s.kind,
+			APIVersion: resource.GroupVersion().String(),
+			Namespace:  s.namespace,
+			Name:       s.name,
+			UID:        s.uid,
+		}
+	}
+	return nil
+}
+
+// less orders the configuration before any other source, then by kind, namespace and name.
+func (s ruleSource) less(other ruleSource) bool {
+	if s.isConfig() != other.isConfig() {
+		return s.isConfig()
+	}
+	if s.kind != other.kind {
+		return s.kind < other.kind
+	}
+	if s.namespace != other.namespace {
+		return s.namespace < other.namespace
+	}
+	return s.name < other.name
+}
+
+// ruleEntry is a rule served by the driver along with every source declaring it.
+// The rule is removed only once its last owner goes away.
+type ruleEntry struct {
+	rule config.MetricRule
+	// owners in source order, the first owner determines the served rule
+	owners []ruleSource
+	// owners declaring a different query than the served rule
+	conflicts []ruleSource
+}
+
+// ruleKey identifies a metric requested within a namespace.
+type ruleKey struct {
+	namespace string
+	name      string
+}
 
 type ExternalMetricsDriver interface {
 	getMetricNames() []string
-	getQuery(metric string) string
+	getRule(namespace, metric string) (config.MetricRule, bool)
+	allowed(namespace string, rule config.MetricRule) (bool, error)
+	getPatterns() []config.PatternRule
+	getEntries(metric string) map[string]ruleEntry
 	registerListener(listener ExternalConfigListener)
+	hasSynced() bool
+	getCustomMetricsMapper() *config.CustomMetricsMapper
+	getMetricPrefixes() []config.MetricPrefix
+	evaluated(namespace, metric string, values *external_metrics.ExternalMetricValueList, err error)
 }
 
 type WavefrontExternalDriver struct {
-	cfgFile    string
-	rules      map[string]config.MetricRule
-	lock       sync.RWMutex
+	cfgFile string
+	sources map[ruleSource][]config.MetricRule
+	// rules served by namespace, the empty namespace holds the cluster-wide rules
+	rules map[string]map[string]*ruleEntry
+	// patterns by source, resolved cluster-wide after the rules
+	patterns map[ruleSource][]config.PatternRule
+	// customMetrics is the custom metrics configuration of the config file or config map
+	customMetrics *config.CustomMetricsConfig
+	customMapper  *config.CustomMetricsMapper
+	lock          sync.RWMutex
+	// cfgLock guards cfgModTime and cfgErr, which the file watch and the config map informer update concurrently
+	cfgLock    sync.Mutex
 	cfgModTime time.Time
+	cfgErr     error
 	listener   ExternalConfigListener
+	recorder   record.EventRecorder
+	podRef     *v1.ObjectReference
+	crdStatus  *crdStatusWriter
+	// synced reports whether the informers of every listener have listed their objects
+	synced []cache.InformerSynced
+	// namespaces provides the labels of namespaces for namespace selectors, nil without a kube client
+	namespaces *namespaceWatcher
+
+	failureLock sync.Mutex
+	failures    map[ruleKey]int
+}
+
+// ExternalDriverConfig configures the sources of external metric rules.
+type ExternalDriverConfig struct {
+	KubeClient kubernetes.Interface
+	DynClient  dynamic.Interface
+	// MetadataClient lists the objects of AnnotatedKinds other than HPAs
+	MetadataClient metadata.Interface
+	// ConfigFile is the external metrics config file, if any
+	ConfigFile string
+	// ConfigMap is the external metrics config map of the form namespace/name[/key], if any
+	ConfigMap string
+	// FailOnInvalidConfig makes an invalid config file or config map fatal on startup
+	FailOnInvalidConfig bool
+	// WatchCRDs enables WavefrontExternalMetric objects as a source of rules
+	WatchCRDs bool
+	// AnnotatedKinds are the kinds whose annotations declare rules, defaults to HPAs only
+	AnnotatedKinds []string
+	// StopCh stops every listener and watch of the driver once closed
+	StopCh <-chan struct{}
 }
 
-func NewExternalMetricsDriver(client kubernetes.Interface, cfgFile string) ExternalMetricsDriver {
-	driver := &WavefrontExternalDriver{
-		cfgFile: cfgFile,
-		rules:   make(map[string]config.MetricRule),
+// NewExternalMetricsDriver returns a driver sourcing rules from the annotations of HPAs or other AnnotatedKinds, the config file or config map
+// and optionally WavefrontExternalMetric objects. An invalid configuration is only fatal
+// if FailOnInvalidConfig is set and the configuration is invalid on startup.
+func NewExternalMetricsDriver(cfg ExternalDriverConfig) ExternalMetricsDriver {
+	driver := newWavefrontExternalDriver()
+	driver.cfgFile = cfg.ConfigFile
+	driver.recorder = newEventRecorder(cfg.KubeClient, cfg.StopCh)
+	driver.podRef = adapterPodRef()
+	if cfg.KubeClient != nil {
+		driver.namespaces = newNamespaceWatcher(cfg.KubeClient, cfg.StopCh)
+	}
+	kinds := cfg.AnnotatedKinds
+	if len(kinds) == 0 {
+		kinds = []string{hpaSourceKind}
+	}
+	if err := validateAnnotatedKinds(kinds); err != nil {
+		log.Fatalf("invalid annotated kinds: %v", err)
+	}
+	for _, kind := range kinds {
+		if kind == hpaSourceKind {
+			driver.synced = append(driver.synced, StartHPAListener(cfg.KubeClient, driver.setRules, cfg.StopCh))
+			continue
+		}
+		// an informer on a resource which is not served never syncs, and would keep the adapter from being ready
+		served, err := workloadServed(cfg.KubeClient.Discovery(), kind)
+		if err != nil {
+			log.Fatalf("unable to discover the resource of annotated kind %s: %v", kind, err)
+		}
+		if !served {
+			log.Warnf("ignoring annotations of %s objects, the resource is not served by the API server", kind)
+			continue
+		}
+		driver.synced = append(driver.synced, StartWorkloadListener(cfg.MetadataClient, kind, driver.setRules, cfg.StopCh))
+	}
+	if cfg.WatchCRDs {
+		driver.crdStatus = newCRDStatusWriter(cfg.DynClient, cfg.StopCh)
+		driver.synced = append(driver.synced, StartCRDListener(cfg.DynClient, driver.setRules, driver.crdStatus, cfg.StopCh))
 	}
-	StartHPAListener(client, driver.addRules, driver.deleteRules)
-	if cfgFile != "" {
-		driver.loadConfig()
+	if cfg.ConfigFile != "" {
+		driver.loadConfig(cfg.FailOnInvalidConfig, cfg.StopCh)
+	}
+	if cfg.ConfigMap != "" {
+		ref, err := parseConfigMapRef(cfg.ConfigMap)
+		if err != nil {
+			log.Fatalf("invalid external metrics config map: %v", err)
+		}
+		driver.loadConfigMap(cfg.KubeClient, ref, cfg.FailOnInvalidConfig, cfg.StopCh)
 	}
 	return driver
 }
 
-func (d *WavefrontExternalDriver) loadConfig() {
-	go wait.Until(func() {
-		fileInfo, err := os.Stat(d.cfgFile)
-		if err != nil {
-			log.Fatalf("unable to get external config file stats: %v", err)
-		}
+func newWavefrontExternalDriver() *WavefrontExternalDriver {
+	return &WavefrontExternalDriver{
+		sources:  make(map[ruleSource][]config.MetricRule),
+		rules:    make(map[string]map[string]*ruleEntry),
+		patterns: make(map[ruleSource][]config.PatternRule),
+		failures: make(map[ruleKey]int),
+	}
+}
 
-		if fileInfo.ModTime().After(d.cfgModTime) {
-			metricsConfig, err := config.FromFile(d.cfgFile)
-			if err != nil {
-				log.Fatalf("unable to load external metrics discovery configuration: %v", err)
-			}
-			d.cfgModTime = fileInfo.ModTime()
-			d.addRules(metricsConfig.Rules)
+func (d *WavefrontExternalDriver) loadConfig(failOnInvalidCfg bool, stopCh <-chan struct{}) {
+	if err := d.reloadConfig(); err != nil && failOnInvalidCfg {
+		log.Fatalf("unable to load external metrics discovery configuration: %v", err)
+	}
+	go d.watchConfigFile(stopCh)
+}
+
+// reloadConfig loads the config file if it changed since the last attempt.
+// On failure the last valid rules are kept and the error is recorded until the file changes again.
+func (d *WavefrontExternalDriver) reloadConfig() error {
+	fileInfo, err := os.Stat(d.cfgFile)
+	if err != nil {
+		err = fmt.Errorf("unable to get external config file stats: %v", err)
+		d.configFailed(err)
+		return err
+	}
+
+	if !d.configChanged(fileInfo.ModTime()) {
+		return nil
+	}
+
+	metricsConfig, err := config.FromFile(d.cfgFile)
+	if err != nil {
+		d.configFailed(err)
+		return err
+	}
+	d.configLoaded()
+	source := ruleSource{kind: fileSourceKind, name: d.cfgFile}
+	d.setRules(source, metricsConfig.Rules)
+	d.setPatterns(source, metricsConfig.Patterns)
+	d.setCustomMetrics(metricsConfig.CustomMetrics)
+	return nil
+}
+
+// configChanged records the modification time of the config file and returns whether it differs from the last one.
+func (d *WavefrontExternalDriver) configChanged(modTime time.Time) bool {
+	d.cfgLock.Lock()
+	defer d.cfgLock.Unlock()
+	if modTime.Equal(d.cfgModTime) {
+		return false
+	}
+	d.cfgModTime = modTime
+	return true
+}
+
+func (d *WavefrontExternalDriver) configFailed(err error) {
+	log.Errorf("unable to load external metrics configuration, keeping the last valid rules: %v", err)
+	externalConfigLoadErrors.Inc()
+	externalConfigValid.Set(0)
+
+	d.cfgLock.Lock()
+	defer d.cfgLock.Unlock()
+	// only record an event when the error changes to avoid flooding the pod with events
+	if d.cfgErr == nil || d.cfgErr.Error() != err.Error() {
+		d.event(v1.EventTypeWarning, "InvalidExternalConfig", "Unable to load external metrics configuration: %v", err)
+	}
+	d.cfgErr = err
+}
+
+func (d *WavefrontExternalDriver) configLoaded() {
+	externalConfigValid.Set(1)
+	d.cfgLock.Lock()
+	defer d.cfgLock.Unlock()
+	if d.cfgErr != nil {
+		log.Info("external metrics configuration is valid again")
+		d.event(v1.EventTypeNormal, "ExternalConfigLoaded", "Loaded external metrics configuration")
+	}
+	d.cfgErr = nil
+}
+
+// evaluated records the outcome of evaluating a metric. Once the evaluation failed
+// evaluationFailureThreshold times in a row, the owners of the rule are notified.
+func (d *WavefrontExternalDriver) evaluated(namespace, metric string, values *external_metrics.ExternalMetricValueList, err error) {
+	key := ruleKey{namespace: namespace, name: metric}
+	owners := d.getOwners(namespace, metric)
+	for _, owner := range owners {
+		if owner.kind == crdSourceKind {
+			d.crdStatus.update(owner, values, err)
 		}
-	}, 1*time.Minute, wait.NeverStop)
+	}
+
+	d.failureLock.Lock()
+	if err == nil {
+		delete(d.failures, key)
+		d.failureLock.Unlock()
+		return
+	}
+	d.failures[key]++
+	failures := d.failures[key]
+	d.failureLock.Unlock()
+
+	if failures%evaluationFailureThreshold != 0 {
+		return
+	}
+	for _, owner := range owners {
+		d.eventFor(owner, v1.EventTypeWarning, "ExternalMetricFailed",
+			"Evaluating external metric %s failed %d times in a row (%s): %v", metric, failures, wave.Category(err), err)
+	}
 }
 
-func (d *WavefrontExternalDriver) addRules(rules []config.MetricRule) {
-	if len(rules) == 0 {
+// eventFor records an event on the object declaring the rules, or on the adapter pod for the config file.
+func (d *WavefrontExternalDriver) eventFor(source ruleSource, eventType, reason, messageFmt string, args ...interface{}) {
+	ref := source.objectRef()
+	if ref == nil {
+		d.event(eventType, reason, messageFmt, args...)
+		return
+	}
+	if d.recorder != nil {
+		d.recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+	}
+}
+
+func (d *WavefrontExternalDriver) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if d.recorder == nil || d.podRef == nil {
 		return
 	}
+	d.recorder.Eventf(d.podRef, eventType, reason, messageFmt, args...)
+}
 
+// setRules replaces all the rules owned by the given source.
+// Rules owned by other sources are never affected.
+func (d *WavefrontExternalDriver) setRules(source ruleSource, rules []config.MetricRule) {
 	d.lock.Lock()
-	for _, rule := range rules {
-		d.rules[rule.Name] = rule
+	previous := d.sources[source]
+	if len(rules) == 0 && len(previous) == 0 {
+		d.lock.Unlock()
+		return
 	}
+	if len(rules) == 0 {
+		delete(d.sources, source)
+	} else {
+		d.sources[source] = rules
+	}
+	conflicts := d.rebuild()
+	listener := d.listener
 	d.lock.Unlock()
 
+	for _, rule := range rules {
+		d.watchNamespacesFor(rule.Access)
+	}
+
+	for _, entry := range conflicts {
+		log.Warnf("conflicting queries for external metric %s: serving %q from %s, ignoring %v",
+			entry.rule.Name, entry.rule.Query, entry.owners[0], entry.conflicts)
+		for _, owner := range entry.conflicts {
+			d.eventFor(owner, v1.EventTypeWarning, "ExternalMetricConflict",
+				"Query for external metric %s is ignored, %s declares a different query", entry.rule.Name, entry.owners[0])
+		}
+	}
+
+	added, changed, removed := diffRules(previous, rules)
+	if len(added) == 0 && len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	log.Debugf("external metrics rules from %s, added: %v, changed: %v, removed: %v", source, added, changed, removed)
+	for _, name := range added {
+		d.eventFor(source, v1.EventTypeNormal, "ExternalMetricRegistered", "Registered external metric %s", name)
+	}
+	for _, name := range changed {
+		d.eventFor(source, v1.EventTypeNormal, "ExternalMetricReplaced", "Replaced query for external metric %s", name)
+	}
+
 	// always release lock before notifying listeners
-	if d.listener != nil {
-		d.listener.configChanged()
+	if listener != nil {
+		listener.configChanged()
 	}
-	log.Debugf("added external metrics rules: %v", rules)
 }
 
-func (d *WavefrontExternalDriver) deleteRules(rules []config.MetricRule) {
-	if len(rules) == 0 {
+// setPatterns replaces all the patterns owned by the given source.
+func (d *WavefrontExternalDriver) setPatterns(source ruleSource, patterns []config.PatternRule) {
+	d.lock.Lock()
+	previous := d.patterns[source]
+	if reflect.DeepEqual(previous, patterns) || len(previous) == 0 && len(patterns) == 0 {
+		d.lock.Unlock()
 		return
 	}
+	if len(patterns) == 0 {
+		delete(d.patterns, source)
+	} else {
+		d.patterns[source] = patterns
+	}
+	listener := d.listener
+	d.lock.Unlock()
+
+	for _, pattern := range patterns {
+		d.watchNamespacesFor(pattern.Access)
+	}
 
+	log.Debugf("external metrics patterns from %s changed", source)
+	// always release lock before notifying listeners
+	if listener != nil {
+		listener.configChanged()
+	}
+}
+
+// setCustomMetrics replaces the custom metrics configuration.
+func (d *WavefrontExternalDriver) setCustomMetrics(cfg *config.CustomMetricsConfig) {
 	d.lock.Lock()
-	for _, rule := range rules {
-		delete(d.rules, rule.Name)
+	if reflect.DeepEqual(d.customMetrics, cfg) {
+		d.lock.Unlock()
+		return
 	}
+	var mapper *config.CustomMetricsMapper
+	if cfg != nil {
+		var err error
+		if mapper, err = cfg.Compile(); err != nil {
+			// validated when loading the configuration
+			log.Errorf("invalid custom metrics config: %v", err)
+			d.lock.Unlock()
+			return
+		}
+	}
+	d.customMetrics = cfg
+	d.customMapper = mapper
+	listener := d.listener
 	d.lock.Unlock()
 
+	log.Info("custom metrics configuration changed")
 	// always release lock before notifying listeners
-	if d.listener != nil {
-		d.listener.configChanged()
+	if listener != nil {
+		listener.configChanged()
 	}
-	log.Debugf("deleted external metrics rules: %v", rules)
 }
 
-func (d *WavefrontExternalDriver) registerListener(listener ExternalConfigListener) {
+func (d *WavefrontExternalDriver) getMetricPrefixes() []config.MetricPrefix {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
+	if d.customMetrics == nil {
+		return nil
+	}
+	return d.customMetrics.Prefixes
+}
+
+func (d *WavefrontExternalDriver) getCustomMetricsMapper() *config.CustomMetricsMapper {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.customMapper
+}
+
+// rebuild recomputes the rules served across all sources and returns the entries with new conflicts.
+// Must be called with the lock held. Sources are applied in a fixed order so the outcome
+// does not depend on the order of events: when owners disagree, the first source in order wins.
+func (d *WavefrontExternalDriver) rebuild() []*ruleEntry {
+	sources := make([]ruleSource, 0, len(d.sources))
+	for source := range d.sources {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].less(sources[j])
+	})
+
+	rules := make(map[string]map[string]*ruleEntry)
+	conflicts := 0
+	for _, source := range sources {
+		// rules from namespaced sources such as HPAs are only visible within their namespace
+		namespaceRules, found := rules[source.namespace]
+		if !found {
+			namespaceRules = make(map[string]*ruleEntry)
+			rules[source.namespace] = namespaceRules
+		}
+		for _, rule := range d.sources[source] {
+			entry, found := namespaceRules[rule.Name]
+			if !found {
+				namespaceRules[rule.Name] = &ruleEntry{rule: rule, owners: []ruleSource{source}}
+				continue
+			}
+			entry.owners = append(entry.owners, source)
+			if !reflect.DeepEqual(entry.rule, rule) {
+				entry.conflicts = append(entry.conflicts, source)
+				conflicts++
+			}
+		}
+	}
+
+	var newConflicts []*ruleEntry
+	for namespace, namespaceRules := range rules {
+		for name, entry := range namespaceRules {
+			if len(entry.conflicts) == 0 {
+				continue
+			}
+			if previous, found := d.rules[namespace][name]; !found || !reflect.DeepEqual(previous.conflicts, entry.conflicts) || !reflect.DeepEqual(previous.rule, entry.rule) {
+				newConflicts = append(newConflicts, entry)
+			}
+		}
+	}
+	externalRuleConflicts.Set(float64(conflicts))
+	d.rules = rules
+	return newConflicts
+}
+
+// diffRules returns the names of the rules added, changed and removed.
+func diffRules(previous, current []config.MetricRule) ([]string, []string, []string) {
+	old := make(map[string]config.MetricRule, len(previous))
+	for _, rule := range previous {
+		old[rule.Name] = rule
+	}
+
+	var added, changed, removed []string
+	for _, rule := range current {
+		oldRule, found := old[rule.Name]
+		if !found {
+			added = append(added, rule.Name)
+		} else if !reflect.DeepEqual(oldRule, rule) {
+			changed = append(changed, rule.Name)
+		}
+		delete(old, rule.Name)
+	}
+	for name := range old {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	return added, changed, removed
+}
+
+func (d *WavefrontExternalDriver) registerListener(listener ExternalConfigListener) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.listener = listener
 	log.Info("external configuration listener registered")
 }
 
+// hasSynced returns true once every listener has seen the objects existing on startup,
+// and namespaces have been listed if any rule restricts its namespaces with a selector.
+func (d *WavefrontExternalDriver) hasSynced() bool {
+	for _, synced := range d.synced {
+		if !synced() {
+			return false
+		}
+	}
+	return d.namespaces == nil || d.namespaces.hasSynced()
+}
+
+// getMetricNames returns the sorted names of the cluster-wide rules available to every namespace.
+// The list is not namespaced, so rules of namespaced sources such as HPAs and rules restricted to some namespaces are left out.
 func (d *WavefrontExternalDriver) getMetricNames() []string {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
 
-	keys := make([]string, 0, len(d.rules))
-	for k := range d.rules {
-		keys = append(keys, k)
+	names := make([]string, 0, len(d.rules[""]))
+	for name, entry := range d.rules[""] {
+		if !entry.rule.Restricted() {
+			names = append(names, name)
+		}
 	}
-	return keys
+	sort.Strings(names)
+	return names
 }
 
-func (d *WavefrontExternalDriver) getQuery(metric string) string {
+// getRule resolves the metric within the given namespace first, then among the cluster-wide rules.
+func (d *WavefrontExternalDriver) getRule(namespace, metric string) (config.MetricRule, bool) {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
 
-	query, found := d.rules[metric]
-	if !found {
-		return ""
+	if entry := d.getEntry(namespace, metric); entry != nil {
+		return entry.rule, true
+	}
+	// rules always take precedence over patterns, the first matching pattern in source order wins
+	for _, source := range d.patternSources() {
+		for _, pattern := range d.patterns[source] {
+			if rule, found := pattern.Match(metric); found {
+				return rule, true
+			}
+		}
+	}
+	return config.MetricRule{}, false
+}
+
+// allowed returns whether the namespace may consume the rule. Rules from namespaced sources such as HPAs are
+// only resolved within their own namespace, cluster-wide rules may restrict the namespaces consuming them.
+// An error is returned while the labels of namespaces are unknown.
+func (d *WavefrontExternalDriver) allowed(namespace string, rule config.MetricRule) (bool, error) {
+	if rule.Allows(namespace, nil) {
+		return true, nil
+	}
+	if rule.NamespaceSelector == "" || d.namespaces == nil {
+		return false, nil
+	}
+	namespaceLabels, err := d.namespaces.labels(namespace)
+	if err != nil {
+		return false, err
+	}
+	return rule.Allows(namespace, namespaceLabels), nil
+}
+
+func (d *WavefrontExternalDriver) getPatterns() []config.PatternRule {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var patterns []config.PatternRule
+	for _, source := range d.patternSources() {
+		patterns = append(patterns, d.patterns[source]...)
+	}
+	return patterns
+}
+
+// patternSources returns the sources declaring patterns in source order. Must be called with the lock held.
+func (d *WavefrontExternalDriver) patternSources() []ruleSource {
+	sources := make([]ruleSource, 0, len(d.patterns))
+	for source := range d.patterns {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].less(sources[j])
+	})
+	return sources
+}
+
+// getOwners returns the sources declaring the rule resolved for the given namespace and metric.
+func (d *WavefrontExternalDriver) getOwners(namespace, metric string) []ruleSource {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	entry := d.getEntry(namespace, metric)
+	if entry == nil {
+		return nil
+	}
+	return append([]ruleSource(nil), entry.owners...)
+}
+
+// getEntry must be called with the lock held.
+func (d *WavefrontExternalDriver) getEntry(namespace, metric string) *ruleEntry {
+	if namespace != "" {
+		if entry, found := d.rules[namespace][metric]; found {
+			return entry
+		}
+	}
+	return d.rules[""][metric]
+}
+
+// getEntries returns a copy of the rules served for the metric keyed by namespace,
+// the empty namespace holds the cluster-wide rule.
+func (d *WavefrontExternalDriver) getEntries(metric string) map[string]ruleEntry {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	entries := make(map[string]ruleEntry)
+	for namespace, namespaceRules := range d.rules {
+		if entry, found := namespaceRules[metric]; found {
+			entries[namespace] = ruleEntry{
+				rule:   entry.rule,
+				owners: append([]ruleSource(nil), entry.owners...),
+			}
+		}
 	}
-	return query.Query
+	return entries
 }
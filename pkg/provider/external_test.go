@@ -0,0 +1,201 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReloadConfigKeepsLastValidRules(t *testing.T) {
+	cfgFile := filepath.Join(t.TempDir(), "config.yaml")
+	driver := newWavefrontExternalDriver()
+	driver.cfgFile = cfgFile
+
+	// a missing file is an error
+	assert.Error(t, driver.reloadConfig())
+
+	writeConfig(t, cfgFile, "rules:\n- name: queue_depth\n  query: ts(queue.depth)\n", time.Now())
+	assert.NoError(t, driver.reloadConfig())
+	assert.Equal(t, "ts(queue.depth)", queryOf(driver, "", "queue_depth"))
+
+	writeConfig(t, cfgFile, "rules: [\n", time.Now().Add(time.Minute))
+	assert.Error(t, driver.reloadConfig())
+	assert.Equal(t, "ts(queue.depth)", queryOf(driver, "", "queue_depth"))
+
+	// an unchanged file is not retried
+	assert.NoError(t, driver.reloadConfig())
+
+	writeConfig(t, cfgFile, "rules:\n- name: queue_depth\n  query: ts(other.depth)\n", time.Now().Add(2*time.Minute))
+	assert.NoError(t, driver.reloadConfig())
+	assert.Equal(t, "ts(other.depth)", queryOf(driver, "", "queue_depth"))
+	assert.Nil(t, driver.cfgErr)
+}
+
+func TestSetRulesReconcilesPerSource(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	file := ruleSource{kind: fileSourceKind, name: "config.yaml"}
+	hpa := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app"}
+
+	driver.setRules(file, []config.MetricRule{
+		{Name: "queue_depth", Query: "ts(queue.depth)"},
+		{Name: "cpu", Query: "ts(cpu)"},
+	})
+	driver.setRules(hpa, []config.MetricRule{{Name: "cpu", Query: "ts(hpa.cpu)"}})
+	assert.ElementsMatch(t, []string{"queue_depth", "cpu"}, driver.getMetricNames())
+	assert.Equal(t, "ts(hpa.cpu)", queryOf(driver, "default", "cpu"))
+
+	// rules removed from the file are deleted
+	driver.setRules(file, []config.MetricRule{{Name: "cpu", Query: "ts(cpu)"}})
+	assert.Equal(t, []string{"cpu"}, driver.getMetricNames())
+
+	// deleting the HPA does not remove the rule still declared in the file
+	driver.setRules(hpa, nil)
+	assert.Equal(t, "ts(cpu)", queryOf(driver, "default", "cpu"))
+
+	driver.setRules(file, nil)
+	assert.Empty(t, driver.getMetricNames())
+}
+
+type countingListener struct {
+	changes int32
+}
+
+func (l *countingListener) configChanged() {
+	atomic.AddInt32(&l.changes, 1)
+}
+
+func TestRegisterListenerWhileSettingRules(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	source := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app"}
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	// informers deliver rules while the listener is registered by a post-start hook
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			driver.setRules(source, []config.MetricRule{{Name: "cpu", Query: "ts(cpu)"}})
+			driver.setRules(source, nil)
+			if i == 0 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	listener := &countingListener{}
+	driver.registerListener(listener)
+	close(stop)
+	<-done
+
+	driver.setRules(source, []config.MetricRule{{Name: "cpu", Query: "ts(cpu)"}})
+	assert.NotZero(t, atomic.LoadInt32(&listener.changes))
+}
+
+func TestNamespacedRules(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	driver.setRules(ruleSource{kind: fileSourceKind, name: "config.yaml"}, []config.MetricRule{{Name: "cpu", Query: "ts(cpu)"}})
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "team-a", name: "app"}, []config.MetricRule{{Name: "queue_depth", Query: "ts(a.depth)"}})
+	driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "team-b", name: "app"}, []config.MetricRule{{Name: "queue_depth", Query: "ts(b.depth)"}})
+
+	// rules of HPAs are only available within their namespace, so only cluster-wide rules are listed
+	assert.Equal(t, []string{"cpu"}, driver.getMetricNames())
+	assert.Equal(t, "ts(a.depth)", queryOf(driver, "team-a", "queue_depth"))
+	assert.Equal(t, "ts(b.depth)", queryOf(driver, "team-b", "queue_depth"))
+	assert.Equal(t, "", queryOf(driver, "team-c", "queue_depth"))
+
+	// cluster-wide rules are visible to every namespace
+	assert.Equal(t, "ts(cpu)", queryOf(driver, "team-c", "cpu"))
+}
+
+func TestSharedRulesAreReferenceCounted(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	app1 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app1"}
+	app2 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app2"}
+	rule := config.MetricRule{Name: "queue_depth", Query: "ts(queue.depth)"}
+
+	driver.setRules(app1, []config.MetricRule{rule})
+	driver.setRules(app2, []config.MetricRule{rule})
+	assert.Equal(t, []ruleSource{app1, app2}, driver.getOwners("default", "queue_depth"))
+
+	driver.setRules(app1, nil)
+	assert.Equal(t, "ts(queue.depth)", queryOf(driver, "default", "queue_depth"))
+	assert.Equal(t, []ruleSource{app2}, driver.getOwners("default", "queue_depth"))
+
+	driver.setRules(app2, nil)
+	assert.Equal(t, "", queryOf(driver, "default", "queue_depth"))
+}
+
+func TestConflictingRulesAreDeterministic(t *testing.T) {
+	app1 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app1"}
+	app2 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app2"}
+
+	for _, order := range [][]ruleSource{{app1, app2}, {app2, app1}} {
+		driver := newWavefrontExternalDriver()
+		for _, source := range order {
+			driver.setRules(source, []config.MetricRule{{Name: "queue_depth", Query: "ts(" + source.name + ")"}})
+		}
+		assert.Equal(t, "ts(app1)", queryOf(driver, "default", "queue_depth"))
+		assert.Equal(t, []ruleSource{app2}, driver.getEntry("default", "queue_depth").conflicts)
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	added, changed, removed := diffRules(
+		[]config.MetricRule{{Name: "a", Query: "ts(a)"}, {Name: "b", Query: "ts(b)"}, {Name: "d", Query: "ts(d)"}},
+		[]config.MetricRule{{Name: "a", Query: "ts(a)"}, {Name: "c", Query: "ts(c)"}, {Name: "d", Query: "ts(e)"}},
+	)
+	assert.Equal(t, []string{"c"}, added)
+	assert.Equal(t, []string{"d"}, changed)
+	assert.Equal(t, []string{"b"}, removed)
+}
+
+func queryOf(driver *WavefrontExternalDriver, namespace, metric string) string {
+	rule, _ := driver.getRule(namespace, metric)
+	return rule.Query
+}
+
+func writeConfig(t *testing.T, filename, contents string, modTime time.Time) {
+	assert.NoError(t, os.WriteFile(filename, []byte(contents), 0644))
+	assert.NoError(t, os.Chtimes(filename, modTime, modTime))
+}
+
+func TestEventsOnOwners(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	driver := newWavefrontExternalDriver()
+	driver.recorder = recorder
+	app1 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app1"}
+	app2 := ruleSource{kind: hpaSourceKind, namespace: "default", name: "app2"}
+
+	driver.setRules(app1, []config.MetricRule{{Name: "queue_depth", Query: "ts(a)"}})
+	assert.Contains(t, <-recorder.Events, "ExternalMetricRegistered")
+
+	driver.setRules(app1, []config.MetricRule{{Name: "queue_depth", Query: "ts(b)"}})
+	assert.Contains(t, <-recorder.Events, "ExternalMetricReplaced")
+
+	driver.setRules(app2, []config.MetricRule{{Name: "queue_depth", Query: "ts(c)"}})
+	assert.Contains(t, <-recorder.Events, "ExternalMetricConflict")
+	assert.Contains(t, <-recorder.Events, "ExternalMetricRegistered")
+
+	err := &client.Error{Type: client.ErrBadStatus, Msg: "error status=400"}
+	for i := 0; i < evaluationFailureThreshold; i++ {
+		assert.Empty(t, recorder.Events)
+		driver.evaluated("default", "queue_depth", nil, err)
+	}
+	assert.Contains(t, <-recorder.Events, "bad_status")
+	assert.Contains(t, <-recorder.Events, "bad_status")
+}
@@ -4,8 +4,10 @@
 package provider
 
 import (
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/external_metrics"
 	"strings"
 )
 
@@ -73,6 +75,9 @@ func (d *fakeExternalDriver) loadConfig() {}
 
 func (d *fakeExternalDriver) registerListener(listener ExternalConfigListener) {}
 
+func (d *fakeExternalDriver) evaluated(namespace, metric string, values *external_metrics.ExternalMetricValueList, err error) {
+}
+
 func (d *fakeExternalDriver) getMetricNames() []string {
 	result := make([]string, 0)
 	result = append(result, "externalMetric1")
@@ -83,9 +88,33 @@ func (d *fakeExternalDriver) getMetricNames() []string {
 	return result
 }
 
-func (d *fakeExternalDriver) getQuery(metric string) string {
+func (d *fakeExternalDriver) getCustomMetricsMapper() *config.CustomMetricsMapper {
+	return nil
+}
+
+func (d *fakeExternalDriver) getMetricPrefixes() []config.MetricPrefix {
+	return nil
+}
+
+func (d *fakeExternalDriver) hasSynced() bool {
+	return true
+}
+
+func (d *fakeExternalDriver) allowed(namespace string, rule config.MetricRule) (bool, error) {
+	return rule.Allows(namespace, nil), nil
+}
+
+func (d *fakeExternalDriver) getPatterns() []config.PatternRule {
+	return nil
+}
+
+func (d *fakeExternalDriver) getEntries(metric string) map[string]ruleEntry {
+	return nil
+}
+
+func (d *fakeExternalDriver) getRule(namespace, metric string) (config.MetricRule, bool) {
 	if strings.HasPrefix(metric, "external") {
-		return "ts(cpu.usage.idle)"
+		return config.MetricRule{Name: metric, Query: "ts(cpu.usage.idle)"}, true
 	}
-	return ""
+	return config.MetricRule{}, false
 }
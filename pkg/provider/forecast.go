@@ -0,0 +1,135 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// seriesValue reduces the transformed points of a series to the value served for the rule.
+// Rules with a forecast serve the projected value instead, bounded relative to the actual value.
+func seriesValue(timeseries wave.Timeseries, data [][]float64, rule config.MetricRule) (float64, error) {
+	if rule.Forecast == nil {
+		return reduce(data, rule.Reduction)
+	}
+	for _, point := range data {
+		if len(point) != 2 {
+			return 0, fmt.Errorf("invalid data point: %v", point)
+		}
+	}
+
+	window := time.Duration(rule.Window)
+	if window <= 0 {
+		window = defaultQueryWindow
+	}
+	actual, err := reduce(recent(data, window), rule.Reduction)
+	if err != nil || !validValue(actual) {
+		return actual, err
+	}
+	predicted := predict(data, *rule.Forecast)
+	served := bound(actual, predicted, *rule.Forecast)
+	log.Debugf("forecast for external metric %s of %s: actual %v, predicted %v, served %v",
+		rule.Name, seriesKey(timeseries), actual, predicted, served)
+	return served, nil
+}
+
+// recent returns the points within the window preceding the last point, as they would be returned for the window.
+func recent(data [][]float64, window time.Duration) [][]float64 {
+	if len(data) == 0 {
+		return data
+	}
+	start := data[len(data)-1][0] - window.Seconds()
+	for i, point := range data {
+		if point[0] >= start {
+			return data[i:]
+		}
+	}
+	return nil
+}
+
+// predict projects the points of a series the horizon past the last point. NaN is returned if the points do not fit the model.
+func predict(data [][]float64, forecast config.Forecast) float64 {
+	points := make([][]float64, 0, len(data))
+	for _, point := range data {
+		if validValue(point[1]) {
+			points = append(points, point)
+		}
+	}
+	if len(points) < 2 {
+		return math.NaN()
+	}
+	horizon := time.Duration(forecast.Horizon).Seconds()
+	switch forecast.Model {
+	case config.ModelLinear:
+		return linearForecast(points, horizon)
+	case config.ModelHolt:
+		alpha, beta := forecast.Smoothing()
+		return holtForecast(points, horizon, alpha, beta)
+	default:
+		return math.NaN()
+	}
+}
+
+// linearForecast extends the least squares line through the points.
+func linearForecast(points [][]float64, horizon float64) float64 {
+	// timestamps relative to the first point keep the sums precise
+	origin := points[0][0]
+	var sumX, sumY, sumXX, sumXY float64
+	for _, point := range points {
+		x := point[0] - origin
+		sumX += x
+		sumY += point[1]
+		sumXX += x * x
+		sumXY += x * point[1]
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return math.NaN()
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	return intercept + slope*(points[len(points)-1][0]-origin+horizon)
+}
+
+// holtForecast applies double exponential smoothing to the points, assuming they are evenly spaced,
+// and extends the final trend over the horizon.
+func holtForecast(points [][]float64, horizon, alpha, beta float64) float64 {
+	step := (points[len(points)-1][0] - points[0][0]) / float64(len(points)-1)
+	if step <= 0 {
+		return math.NaN()
+	}
+	level, trend := points[0][1], points[1][1]-points[0][1]
+	for _, point := range points[1:] {
+		previous := level
+		level = alpha*point[1] + (1-alpha)*(level+trend)
+		trend = beta*(level-previous) + (1-beta)*trend
+	}
+	return level + trend*horizon/step
+}
+
+// bound keeps the predicted value within the ratios of the actual value, serving the actual value if there is no prediction.
+// The ratios of an actual value of 0 only allow 0, so the ceiling raises the upper bound to let forecasts lead from there.
+func bound(actual, predicted float64, forecast config.Forecast) float64 {
+	if !validValue(predicted) {
+		return actual
+	}
+	minRatio, maxRatio := forecast.Ratios()
+	low, high := actual*minRatio, actual*maxRatio
+	if low > high {
+		// negative values
+		low, high = high, low
+	}
+	if forecast.Ceiling != nil {
+		high = math.Max(high, *forecast.Ceiling)
+	}
+	return math.Min(math.Max(predicted, low), high)
+}
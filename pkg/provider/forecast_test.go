@@ -0,0 +1,116 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// trendData grows by 10 every minute
+var trendData = [][]float64{
+	{1600000000, 100},
+	{1600000060, 110},
+	{1600000120, 120},
+	{1600000180, 130},
+	{1600000240, 140},
+}
+
+func forecastOf(model string, horizon time.Duration) config.Forecast {
+	return config.Forecast{Model: model, Horizon: config.Duration(horizon)}
+}
+
+func TestLinearForecast(t *testing.T) {
+	assert.InDelta(t, 190, predict(trendData, forecastOf(config.ModelLinear, 5*time.Minute)), 1e-9)
+
+	// noise around the trend is fit by least squares
+	noisy := [][]float64{{0, 1}, {60, 3}, {120, 2}, {180, 4}}
+	assert.InDelta(t, 5.3, predict(noisy, forecastOf(config.ModelLinear, 2*time.Minute)), 1e-9)
+
+	// invalid values are ignored, a single point has no trend
+	assert.InDelta(t, 135, predict([][]float64{{0, 100}, {60, math.NaN()}, {120, 120}}, forecastOf(config.ModelLinear, 90*time.Second)), 1e-9)
+	assert.True(t, math.IsNaN(predict([][]float64{{0, 100}, {60, math.NaN()}}, forecastOf(config.ModelLinear, time.Minute))))
+}
+
+func TestHoltForecast(t *testing.T) {
+	// a steady trend is followed exactly
+	assert.InDelta(t, 190, predict(trendData, forecastOf(config.ModelHolt, 5*time.Minute)), 1e-9)
+
+	// a recent change of trend is picked up according to the smoothing factors
+	turning := [][]float64{{0, 100}, {60, 100}, {120, 100}, {180, 120}, {240, 140}}
+	forecast := forecastOf(config.ModelHolt, 2*time.Minute)
+	forecast.Alpha, forecast.Beta = 1, 1
+	assert.InDelta(t, 180, predict(turning, forecast), 1e-9)
+	// the defaults smooth the change
+	forecast.Alpha, forecast.Beta = 0, 0
+	assert.InDelta(t, 130.4, predict(turning, forecast), 1e-9)
+}
+
+func TestForecastBounds(t *testing.T) {
+	forecast := forecastOf(config.ModelLinear, time.Minute)
+	assert.Equal(t, 150.0, bound(100, 150, forecast))
+	assert.Equal(t, 200.0, bound(100, 500, forecast))
+	assert.Equal(t, 50.0, bound(100, -20, forecast))
+	assert.Equal(t, 100.0, bound(100, math.NaN(), forecast))
+	assert.Equal(t, -50.0, bound(-100, 0, forecast))
+
+	min, max := 1.0, 1.2
+	forecast.MinRatio, forecast.MaxRatio = &min, &max
+	assert.Equal(t, 100.0, bound(100, 80, forecast))
+	assert.Equal(t, 120.0, bound(100, 150, forecast))
+
+	// an actual value of 0 only allows 0 unless a ceiling lets the forecast lead
+	assert.Equal(t, 0.0, bound(0, 40, forecast))
+	ceiling := 50.0
+	forecast.Ceiling = &ceiling
+	assert.Equal(t, 40.0, bound(0, 40, forecast))
+	assert.Equal(t, 50.0, bound(0, 80, forecast))
+	// the ratios still apply above the ceiling
+	assert.Equal(t, 200.0, bound(200, 150, forecast))
+	assert.Equal(t, 240.0, bound(200, 300, forecast))
+}
+
+func TestServeForecast(t *testing.T) {
+	forecast := forecastOf(config.ModelLinear, 5*time.Minute)
+	rule := config.MetricRule{Name: "requests", Window: config.Duration(2 * time.Minute), Reduction: config.ReductionAvg, Forecast: &forecast}
+	assert.Equal(t, time.Hour, rule.QueryWindow())
+
+	// the actual value is the average over the last 2 minutes, the forecast is bounded to twice that value
+	translator := NewWavefrontTranslator("kubernetes")
+	values, err := translator.ExternalValuesFor(client.QueryResult{Timeseries: []client.Timeseries{{Data: trendData}}}, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, "190", values.Items[0].Value.String())
+
+	max := 1.25
+	forecast.MaxRatio = &max
+	values, err = translator.ExternalValuesFor(client.QueryResult{Timeseries: []client.Timeseries{{Data: trendData}}}, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, "162500m", values.Items[0].Value.String())
+
+	// without a trend the actual value is served
+	values, err = translator.ExternalValuesFor(client.QueryResult{Timeseries: []client.Timeseries{{Data: trendData[:1]}}}, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, "100", values.Items[0].Value.String())
+}
+
+func TestValidateForecast(t *testing.T) {
+	negative, low := -1.0, 0.2
+	for forecast, message := range map[*config.Forecast]string{
+		{Model: "arima", Horizon: config.Duration(time.Minute)}:                                 `invalid forecast model "arima" for rule: r`,
+		{Model: config.ModelLinear}:                                                             "missing forecast horizon for rule: r",
+		{Model: config.ModelHolt, Horizon: config.Duration(time.Minute), Alpha: 1.5}:            "forecast alpha and beta must be between 0 and 1 for rule: r",
+		{Model: config.ModelLinear, Horizon: config.Duration(time.Minute), MinRatio: &negative}: "invalid forecast ratios from -1 to 2 for rule: r",
+		{Model: config.ModelLinear, Horizon: config.Duration(time.Minute), MaxRatio: &low}:      "invalid forecast ratios from 0.5 to 0.2 for rule: r",
+		{Model: config.ModelLinear, Horizon: config.Duration(time.Minute), Ceiling: &negative}:  "negative forecast ceiling -1 for rule: r",
+	} {
+		rule := config.MetricRule{Name: "r", Query: "ts(a)", Forecast: forecast}
+		assert.EqualError(t, rule.Validate(), message)
+	}
+}
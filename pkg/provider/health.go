@@ -0,0 +1,93 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apiserver/pkg/server/healthz"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+)
+
+const (
+	// probeQuery is a cheap query used to verify connectivity and credentials, it need not return any data
+	probeQuery = `ts("~wavefront.adapter.probe")`
+
+	// probeInterval is the minimum interval between two connectivity probes until one succeeds
+	probeInterval = 10 * time.Second
+)
+
+// HealthProvider is implemented by providers reporting their readiness and liveness.
+type HealthProvider interface {
+	// ReadyzChecks fail until the adapter is able to serve metrics
+	ReadyzChecks() []healthz.HealthChecker
+	// LivezChecks fail once the adapter no longer makes progress
+	LivezChecks() []healthz.HealthChecker
+}
+
+var _ HealthProvider = &wavefrontProvider{}
+
+func (p *wavefrontProvider) ReadyzChecks() []healthz.HealthChecker {
+	probe := &wavefrontProbe{client: p.waveClient}
+	return []healthz.HealthChecker{
+		healthz.NamedCheck("external-rules-synced", func(_ *http.Request) error {
+			if !p.externalDriver.hasSynced() {
+				return fmt.Errorf("external metric rules have not been synced yet")
+			}
+			return nil
+		}),
+		healthz.NamedCheck("metrics-listed", func(_ *http.Request) error {
+			if !p.lister.HasSynced() {
+				return fmt.Errorf("custom metrics have not been listed yet")
+			}
+			return nil
+		}),
+		healthz.NamedCheck("wavefront-connectivity", func(_ *http.Request) error {
+			return probe.check()
+		}),
+	}
+}
+
+func (p *wavefrontProvider) LivezChecks() []healthz.HealthChecker {
+	return []healthz.HealthChecker{
+		healthz.NamedCheck("metrics-relist", func(_ *http.Request) error {
+			return p.lister.CheckRelist()
+		}),
+	}
+}
+
+// wavefrontProbe verifies that Wavefront can be queried. Once a probe succeeded it is never repeated,
+// later failures are reflected by the errors of the metrics requests instead.
+type wavefrontProbe struct {
+	client    wave.WavefrontClient
+	lock      sync.Mutex
+	succeeded bool
+	lastProbe time.Time
+	lastErr   error
+}
+
+func (w *wavefrontProbe) check() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.succeeded {
+		return nil
+	}
+	if time.Since(w.lastProbe) < probeInterval {
+		return w.lastErr
+	}
+	w.lastProbe = time.Now()
+	_, err := w.client.Query(time.Now().Add(-defaultQueryWindow).Unix(), probeQuery)
+	if err != nil {
+		w.lastErr = fmt.Errorf("unable to query Wavefront: %v", err)
+		return w.lastErr
+	}
+	w.succeeded = true
+	w.lastErr = nil
+	return nil
+}
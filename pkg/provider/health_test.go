@@ -0,0 +1,73 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+)
+
+// unavailableClient fails every request until it is made available
+type unavailableClient struct {
+	client.WavefrontClient
+	available bool
+	queries   int
+}
+
+func (c *unavailableClient) Query(start int64, query string) (client.QueryResult, error) {
+	c.queries++
+	if !c.available {
+		return client.QueryResult{}, &client.Error{Type: client.ErrUnavailable, Msg: "connection refused"}
+	}
+	return c.WavefrontClient.Query(start, query)
+}
+
+func TestReadyzChecks(t *testing.T) {
+	p := fakeProvider().(*wavefrontProvider)
+	for _, check := range p.ReadyzChecks() {
+		assert.NoError(t, check.Check(nil), check.Name())
+	}
+
+	p.lister = &WavefrontMetricsLister{}
+	checks := p.ReadyzChecks()
+	assert.Equal(t, "metrics-listed", checks[1].Name())
+	assert.EqualError(t, checks[1].Check(nil), "custom metrics have not been listed yet")
+}
+
+func TestWavefrontProbe(t *testing.T) {
+	waveClient := &unavailableClient{WavefrontClient: client.NewFakeWavefrontClient()}
+	probe := &wavefrontProbe{client: waveClient}
+
+	assert.EqualError(t, probe.check(), "unable to query Wavefront: unavailable: connection refused")
+	// failures are cached for the probe interval
+	waveClient.available = true
+	assert.Error(t, probe.check())
+	assert.Equal(t, 1, waveClient.queries)
+
+	probe.lastProbe = time.Now().Add(-probeInterval)
+	assert.NoError(t, probe.check())
+
+	// once succeeded the probe is never repeated
+	waveClient.available = false
+	assert.NoError(t, probe.check())
+	assert.Equal(t, 2, waveClient.queries)
+}
+
+func TestCheckRelist(t *testing.T) {
+	lister := &WavefrontMetricsLister{UpdateInterval: time.Minute}
+	assert.NoError(t, lister.CheckRelist())
+
+	lister.started = time.Now()
+	assert.NoError(t, lister.CheckRelist())
+
+	lister.lastUpdate = time.Now().Add(-2*time.Minute - relistGracePeriod - time.Second)
+	assert.Error(t, lister.CheckRelist())
+
+	lister.lastUpdate = time.Now()
+	assert.NoError(t, lister.CheckRelist())
+}
@@ -9,7 +9,6 @@ import (
 	"k8s.io/api/autoscaling/v2"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"reflect"
@@ -22,20 +21,22 @@ const (
 
 type hpaListener struct {
 	kubeClient kubernetes.Interface
-	addFunc    RuleHandlerFunc
-	deleteFunc RuleHandlerFunc
+	setFunc    RuleHandlerFunc
+	stopCh     <-chan struct{}
 }
 
-func StartHPAListener(client kubernetes.Interface, addFunc, deleteFunc RuleHandlerFunc) {
+// StartHPAListener sources external metric rules from HPA annotations until stopCh is closed.
+// The returned function reports whether every HPA has been listed.
+func StartHPAListener(client kubernetes.Interface, setFunc RuleHandlerFunc, stopCh <-chan struct{}) cache.InformerSynced {
 	listener := &hpaListener{
 		kubeClient: client,
-		addFunc:    addFunc,
-		deleteFunc: deleteFunc,
+		setFunc:    setFunc,
+		stopCh:     stopCh,
 	}
-	go listener.listen()
+	return listener.listen()
 }
 
-func (l *hpaListener) listen() {
+func (l *hpaListener) listen() cache.InformerSynced {
 	log.Info("listening for HPA instances")
 
 	rc := l.kubeClient.AutoscalingV2().RESTClient()
@@ -45,10 +46,7 @@ func (l *hpaListener) listen() {
 	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			hpa := obj.(*v2.HorizontalPodAutoscaler)
-			rules := rulesFromAnnotations(hpa.Annotations)
-			if len(rules) > 0 {
-				l.addFunc(rules)
-			}
+			l.setFunc(hpaSource(hpa), rulesFromAnnotations(hpa.Annotations))
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldHPA := oldObj.(*v2.HorizontalPodAutoscaler)
@@ -60,25 +58,31 @@ func (l *hpaListener) listen() {
 				log.Debugf("annotations have not changed for %s", newHPA.Name)
 				return
 			}
-
-			oldRules := rulesFromAnnotations(oldHPA.Annotations)
-			if len(oldRules) > 0 {
-				l.deleteFunc(oldRules)
-			}
-			newRules := rulesFromAnnotations(newHPA.Annotations)
-			if len(newRules) > 0 {
-				l.addFunc(newRules)
-			}
+			l.setFunc(hpaSource(newHPA), rulesFromAnnotations(newHPA.Annotations))
 		},
 		DeleteFunc: func(obj interface{}) {
-			hpa := obj.(*v2.HorizontalPodAutoscaler)
-			rules := rulesFromAnnotations(hpa.Annotations)
-			if len(rules) > 0 {
-				l.deleteFunc(rules)
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			hpa, ok := obj.(*v2.HorizontalPodAutoscaler)
+			if !ok {
+				log.Errorf("unexpected object deleted: %T", obj)
+				return
 			}
+			l.setFunc(hpaSource(hpa), nil)
 		},
 	})
-	go inf.Run(wait.NeverStop)
+	go inf.Run(l.stopCh)
+	return inf.HasSynced
+}
+
+func hpaSource(hpa *v2.HorizontalPodAutoscaler) ruleSource {
+	return ruleSource{
+		kind:      hpaSourceKind,
+		namespace: hpa.Namespace,
+		name:      hpa.Name,
+		uid:       hpa.UID,
+	}
 }
 
 func rulesFromAnnotations(annotations map[string]string) []config.MetricRule {
@@ -87,12 +91,21 @@ func rulesFromAnnotations(annotations map[string]string) []config.MetricRule {
 	for k, v := range annotations {
 		if strings.HasPrefix(k, metricAnnotationPrefix) {
 			if len(k) > plen+1 {
-				rules = append(rules, config.MetricRule{
-					Name:  k[plen+1:],
-					Query: v,
-				})
+				rules = append(rules, annotationRule(k[plen+1:], v))
 			}
 		}
 	}
 	return rules
 }
+
+// annotationRule returns the rule declared by an annotation. Annotations cannot list params,
+// so every parameter referenced by the query is read from the metricSelector of the request.
+func annotationRule(name, query string) config.MetricRule {
+	rule := config.MetricRule{Name: name, Query: query}
+	for _, param := range config.Placeholders(query) {
+		if param != config.NamespaceParam && param != config.ClusterParam && !contains(rule.Params, param) {
+			rule.Params = append(rule.Params, param)
+		}
+	}
+	return rule
+}
@@ -0,0 +1,308 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/keda/externalscaler"
+)
+
+// metadata keys of the ScaledObject triggers served by the external scaler
+const (
+	scalerMetricName      = "metricName"
+	scalerQuery           = "query"
+	scalerTargetValue     = "targetValue"
+	scalerActivationValue = "activationValue"
+	scalerWindow          = "window"
+	scalerReduction       = "reduction"
+	scalerFallback        = "fallback"
+
+	// defaultScalerMetricName is the metric name reported for triggers declaring a query
+	defaultScalerMetricName = "wavefront"
+	// defaultStreamInterval is the interval at which StreamIsActive evaluates the trigger
+	defaultStreamInterval = 30 * time.Second
+)
+
+// ExternalScalerProvider is implemented by providers able to serve the ExternalScaler gRPC service of KEDA.
+type ExternalScalerProvider interface {
+	ExternalScaler(allowQueries bool) externalscaler.ExternalScalerServer
+}
+
+// ExternalScaler returns a KEDA external scaler evaluating the rule named by the metricName metadata
+// of a ScaledObject trigger. The ts query of the query metadata is only evaluated if allowQueries is set,
+// as it lets any client of the scaler run arbitrary queries against Wavefront.
+func (p *wavefrontProvider) ExternalScaler(allowQueries bool) externalscaler.ExternalScalerServer {
+	return &kedaScaler{provider: p, streamInterval: defaultStreamInterval, allowQueries: allowQueries}
+}
+
+var _ ExternalScalerProvider = &wavefrontProvider{}
+
+type kedaScaler struct {
+	externalscaler.UnimplementedExternalScalerServer
+
+	provider       *wavefrontProvider
+	streamInterval time.Duration
+	allowQueries   bool
+}
+
+// scalerTrigger is the rule of a ScaledObject trigger along with its target and activation values.
+type scalerTrigger struct {
+	rule       config.MetricRule
+	params     map[string]string
+	named      bool
+	target     int64
+	activation float64
+}
+
+func (s *kedaScaler) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	trigger, err := s.triggerFor(ref)
+	if err != nil {
+		return nil, err
+	}
+	active, err := s.isActive(ref, trigger)
+	if err != nil {
+		return nil, err
+	}
+	return &externalscaler.IsActiveResponse{Result: active}, nil
+}
+
+// StreamIsActive evaluates the trigger periodically and sends its activity whenever it changes, until the stream is closed.
+// Failed evaluations are logged and retried on the next interval.
+func (s *kedaScaler) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	trigger, err := s.triggerFor(ref)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(s.streamInterval)
+	defer ticker.Stop()
+
+	sent, last := false, false
+	for {
+		active, err := s.isActive(ref, trigger)
+		if err != nil {
+			log.Warningf("unable to evaluate external scaler for %s/%s: %v", ref.Namespace, ref.Name, err)
+		} else if !sent || active != last {
+			if err := stream.Send(&externalscaler.IsActiveResponse{Result: active}); err != nil {
+				return err
+			}
+			sent, last = true, active
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *kedaScaler) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	trigger, err := s.triggerFor(ref)
+	if err != nil {
+		return nil, err
+	}
+	if trigger.target <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "missing %s for external scaler %s/%s", scalerTargetValue, ref.Namespace, ref.Name)
+	}
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{MetricName: trigger.rule.Name, TargetSize: trigger.target}},
+	}, nil
+}
+
+func (s *kedaScaler) GetMetrics(ctx context.Context, req *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	ref := req.ScaledObjectRef
+	if ref == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing scaled object")
+	}
+	trigger, err := s.triggerFor(ref)
+	if err != nil {
+		return nil, err
+	}
+	value, found, err := s.evaluate(ref, trigger)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, status.Errorf(codes.NotFound, "no data for external scaler %s/%s", ref.Namespace, ref.Name)
+	}
+	name := req.MetricName
+	if name == "" {
+		name = trigger.rule.Name
+	}
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{MetricName: name, MetricValue: int64(math.Round(value))}},
+	}, nil
+}
+
+// isActive returns whether the value of the trigger exceeds its activation value. Triggers without data are inactive.
+func (s *kedaScaler) isActive(ref *externalscaler.ScaledObjectRef, trigger scalerTrigger) (bool, error) {
+	value, found, err := s.evaluate(ref, trigger)
+	if err != nil || !found {
+		return false, err
+	}
+	return value > trigger.activation, nil
+}
+
+// evaluate returns the sum of the values of all series returned for the trigger, as the HPA does for external metrics.
+func (s *kedaScaler) evaluate(ref *externalscaler.ScaledObjectRef, trigger scalerTrigger) (float64, bool, error) {
+	p := s.provider
+	rule := trigger.rule
+	var values *external_metrics.ExternalMetricValueList
+	var err error
+	if rule.Composite() {
+		var queries map[string]string
+		if queries, err = expandQueries(rule, trigger.params); err != nil {
+			return 0, false, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var results map[string]wave.QueryResult
+		if results, err = p.queryAll(queries, rule.QueryWindow()); err != nil {
+			return 0, false, s.queryFailed(ref, trigger, err)
+		}
+		values, _, err = compositeValuesFor(results, rule)
+	} else {
+		var query string
+		if query, err = expandQuery(rule, trigger.params); err != nil {
+			return 0, false, status.Error(codes.InvalidArgument, err.Error())
+		}
+		var queryResult wave.QueryResult
+		if queryResult, err = p.rawQuery(query, rule.QueryWindow()); err != nil {
+			return 0, false, s.queryFailed(ref, trigger, err)
+		}
+		values, err = p.ExternalValuesFor(queryResult, rule)
+	}
+	if err != nil {
+		s.evaluated(ref, trigger, nil, &wave.Error{Type: wave.ErrBadData, Msg: err.Error()})
+		return 0, false, status.Error(codes.Internal, err.Error())
+	}
+	s.evaluated(ref, trigger, values, nil)
+
+	var sum float64
+	for _, value := range values.Items {
+		sum += value.Value.AsApproximateFloat64()
+	}
+	return sum, len(values.Items) > 0, nil
+}
+
+// queryFailed records the failure of a query to Wavefront and returns the error served to KEDA.
+func (s *kedaScaler) queryFailed(ref *externalscaler.ScaledObjectRef, trigger scalerTrigger, err error) error {
+	log.Errorf("unable to fetch metrics from wavefront: %v", err)
+	s.evaluated(ref, trigger, nil, err)
+	// don't leak implementation details to the user
+	return status.Errorf(codes.Unavailable, "error fetching metrics for external scaler %s/%s", ref.Namespace, ref.Name)
+}
+
+// evaluated records the outcome of evaluating a rule known to the external driver.
+func (s *kedaScaler) evaluated(ref *externalscaler.ScaledObjectRef, trigger scalerTrigger, values *external_metrics.ExternalMetricValueList, err error) {
+	if trigger.named && s.provider.externalDriver != nil {
+		s.provider.externalDriver.evaluated(ref.Namespace, trigger.rule.Name, values, err)
+	}
+}
+
+// triggerFor resolves the rule of a ScaledObject trigger from its metadata. The metricName refers to a rule
+// known to the adapter within the namespace of the ScaledObject, while a query declares the rule inline if allowed.
+// All other metadata entries are available as parameters of the query.
+func (s *kedaScaler) triggerFor(ref *externalscaler.ScaledObjectRef) (scalerTrigger, error) {
+	metadata := ref.ScalerMetadata
+	name, query := metadata[scalerMetricName], metadata[scalerQuery]
+
+	var trigger scalerTrigger
+	switch {
+	case name != "" && query != "":
+		return trigger, status.Errorf(codes.InvalidArgument, "only one of %s and %s can be specified", scalerMetricName, scalerQuery)
+	case name != "":
+		if s.provider.externalDriver == nil {
+			return trigger, status.Errorf(codes.NotFound, "missing external driver for external metric: %s", name)
+		}
+		rule, found := s.provider.externalDriver.getRule(ref.Namespace, name)
+		if !found {
+			return trigger, status.Errorf(codes.NotFound, "missing query for external metric: %s", name)
+		}
+		allowed, err := s.provider.externalDriver.allowed(ref.Namespace, rule)
+		if err != nil {
+			return trigger, status.Errorf(codes.Unavailable, "unable to check access to external metric %s: %v", name, err)
+		}
+		if !allowed {
+			return trigger, status.Errorf(codes.PermissionDenied, "external metric %s is not available in namespace %s", name, ref.Namespace)
+		}
+		trigger.rule, trigger.named = rule, true
+	case query != "":
+		if !s.allowQueries {
+			return trigger, status.Errorf(codes.PermissionDenied, "%s metadata is disabled, use %s to refer to a rule", scalerQuery, scalerMetricName)
+		}
+		rule, err := inlineRule(query, metadata)
+		if err != nil {
+			return trigger, status.Error(codes.InvalidArgument, err.Error())
+		}
+		trigger.rule = rule
+	default:
+		return trigger, status.Errorf(codes.InvalidArgument, "one of %s and %s is required", scalerMetricName, scalerQuery)
+	}
+
+	if value, found := metadata[scalerTargetValue]; found {
+		target, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || target <= 0 {
+			return trigger, status.Errorf(codes.InvalidArgument, "invalid %s %q, expected a positive integer", scalerTargetValue, value)
+		}
+		trigger.target = target
+	}
+	if value, found := metadata[scalerActivationValue]; found {
+		activation, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return trigger, status.Errorf(codes.InvalidArgument, "invalid %s %q", scalerActivationValue, value)
+		}
+		trigger.activation = activation
+	}
+
+	trigger.params = make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		trigger.params[key] = value
+	}
+	// built-in parameters take precedence over metadata
+	for key, value := range requestParams(ref.Namespace, s.provider.clusterName, nil) {
+		trigger.params[key] = value
+	}
+	return trigger, nil
+}
+
+// inlineRule returns the rule declared by the query, window, reduction and fallback metadata of a trigger.
+func inlineRule(query string, metadata map[string]string) (config.MetricRule, error) {
+	rule := config.MetricRule{
+		Name:      defaultScalerMetricName,
+		Query:     query,
+		Reduction: metadata[scalerReduction],
+	}
+	if value, found := metadata[scalerWindow]; found {
+		window, err := time.ParseDuration(value)
+		if err != nil {
+			return rule, fmt.Errorf("invalid %s %q: %v", scalerWindow, value, err)
+		}
+		rule.Window = config.Duration(window)
+	}
+	if value, found := metadata[scalerFallback]; found {
+		fallback, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return rule, fmt.Errorf("invalid %s %q", scalerFallback, value)
+		}
+		rule.Fallback = &fallback
+	}
+	// every parameter referenced by the query is read from the metadata
+	for _, param := range config.Placeholders(query) {
+		if param != config.NamespaceParam && param != config.ClusterParam {
+			rule.Params = append(rule.Params, param)
+		}
+	}
+	return rule, rule.Validate()
+}
@@ -0,0 +1,192 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/keda/externalscaler"
+)
+
+func kedaScalerFor(waveClient client.WavefrontClient) *kedaScaler {
+	p := &wavefrontProvider{
+		waveClient:     waveClient,
+		externalDriver: &fakeExternalDriver{},
+		clusterName:    "prod",
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+	return p.ExternalScaler(true).(*kedaScaler)
+}
+
+func valueSeries(queue string, value float64) client.Timeseries {
+	return client.Timeseries{
+		Tags: map[string]string{"QueueName": queue},
+		Data: [][]float64{{1600000000, 0}, {1600000060, value}},
+	}
+}
+
+func TestKedaScalerRule(t *testing.T) {
+	waveClient := &seriesClient{series: map[string][]client.Timeseries{
+		"cpu.usage.idle": {valueSeries("a", 4.4), valueSeries("b", 3)},
+	}}
+	scaler := kedaScalerFor(waveClient)
+	ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: map[string]string{
+		"metricName": "externalMetric1", "targetValue": "5", "activationValue": "7",
+	}}
+
+	spec, err := scaler.GetMetricSpec(context.Background(), ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "externalMetric1", spec.MetricSpecs[0].MetricName)
+	assert.Equal(t, int64(5), spec.MetricSpecs[0].TargetSize)
+
+	// values of all series are summed
+	metrics, err := scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref, MetricName: "s0-externalMetric1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "s0-externalMetric1", metrics.MetricValues[0].MetricName)
+	assert.Equal(t, int64(7), metrics.MetricValues[0].MetricValue)
+
+	active, err := scaler.IsActive(context.Background(), ref)
+	assert.NoError(t, err)
+	assert.True(t, active.Result)
+
+	ref.ScalerMetadata["activationValue"] = "8"
+	active, err = scaler.IsActive(context.Background(), ref)
+	assert.NoError(t, err)
+	assert.False(t, active.Result)
+
+	ref.ScalerMetadata["metricName"] = "unknown"
+	_, err = scaler.IsActive(context.Background(), ref)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestKedaScalerQuery(t *testing.T) {
+	waveClient := &seriesClient{series: map[string][]client.Timeseries{
+		"aws.sqs.approximatenumberofmessagesvisible": {valueSeries("orders", 12)},
+	}}
+	scaler := kedaScalerFor(waveClient)
+	ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: map[string]string{
+		"query":       `ts(aws.sqs.approximatenumberofmessagesvisible, QueueName="${queue}" and cluster="${cluster}")`,
+		"queue":       "orders",
+		"reduction":   "max",
+		"targetValue": "10",
+	}}
+
+	spec, err := scaler.GetMetricSpec(context.Background(), ref)
+	assert.NoError(t, err)
+	assert.Equal(t, "wavefront", spec.MetricSpecs[0].MetricName)
+
+	metrics, err := scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), metrics.MetricValues[0].MetricValue)
+	assert.Equal(t, `ts(aws.sqs.approximatenumberofmessagesvisible, QueueName="orders" and cluster="prod")`, waveClient.queries[0])
+
+	// parameters are read from the metadata
+	delete(ref.ScalerMetadata, "queue")
+	_, err = scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestKedaScalerInvalidMetadata(t *testing.T) {
+	scaler := kedaScalerFor(&seriesClient{})
+	for name, metadata := range map[string]map[string]string{
+		"missing rule":        {"targetValue": "1"},
+		"rule and query":      {"metricName": "externalMetric1", "query": "ts(a)"},
+		"invalid target":      {"metricName": "externalMetric1", "targetValue": "1.5"},
+		"invalid activation":  {"metricName": "externalMetric1", "activationValue": "x"},
+		"invalid window":      {"query": "ts(a)", "window": "5"},
+		"invalid reduction":   {"query": "ts(a)", "reduction": "median"},
+		"missing targetValue": {"query": "ts(a)"},
+	} {
+		ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: metadata}
+		_, err := scaler.GetMetricSpec(context.Background(), ref)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), name)
+	}
+}
+
+func TestKedaScalerQueriesDisabled(t *testing.T) {
+	waveClient := &seriesClient{}
+	scaler := kedaScalerFor(waveClient)
+	scaler.allowQueries = false
+	ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: map[string]string{"query": "ts(a)", "targetValue": "1"}}
+
+	_, err := scaler.GetMetricSpec(context.Background(), ref)
+	assert.EqualError(t, err, "rpc error: code = PermissionDenied desc = query metadata is disabled, use metricName to refer to a rule")
+	_, err = scaler.IsActive(context.Background(), ref)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Empty(t, waveClient.queries)
+}
+
+func TestKedaScalerNoData(t *testing.T) {
+	scaler := kedaScalerFor(&seriesClient{})
+	ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: map[string]string{"query": "ts(a)"}}
+
+	active, err := scaler.IsActive(context.Background(), ref)
+	assert.NoError(t, err)
+	assert.False(t, active.Result)
+
+	_, err = scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	ref.ScalerMetadata["fallback"] = "3"
+	metrics, err := scaler.GetMetrics(context.Background(), &externalscaler.GetMetricsRequest{ScaledObjectRef: ref})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), metrics.MetricValues[0].MetricValue)
+}
+
+// countingClient counts the queries of concurrent callers
+type countingClient struct {
+	client.WavefrontClient
+	queries int32
+}
+
+func (c *countingClient) Query(start int64, query string) (client.QueryResult, error) {
+	atomic.AddInt32(&c.queries, 1)
+	return c.WavefrontClient.Query(start, query)
+}
+
+type activityStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent chan bool
+}
+
+func (s *activityStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *activityStream) Send(response *externalscaler.IsActiveResponse) error {
+	s.sent <- response.Result
+	return nil
+}
+
+func TestKedaScalerStream(t *testing.T) {
+	waveClient := &countingClient{WavefrontClient: &seriesClient{series: map[string][]client.Timeseries{"queue.depth": {valueSeries("a", 1)}}}}
+	scaler := kedaScalerFor(waveClient)
+	scaler.streamInterval = 10 * time.Millisecond
+	ref := &externalscaler.ScaledObjectRef{Name: "worker", Namespace: "default", ScalerMetadata: map[string]string{"query": "ts(queue.depth)"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &activityStream{ctx: ctx, sent: make(chan bool, 10)}
+	done := make(chan error)
+	go func() {
+		done <- scaler.StreamIsActive(ref, stream)
+	}()
+
+	assert.True(t, <-stream.sent)
+	// the activity is only sent again once it changes
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&waveClient.queries) > 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, stream.sent, 0)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
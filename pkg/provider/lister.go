@@ -5,6 +5,9 @@ package provider
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,14 +16,36 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
 
+const (
+	// patternDiscoveryWindow is how far back the discovery queries of patterns look for series
+	patternDiscoveryWindow = 5 * time.Minute
+
+	// relistGracePeriod is added to twice the update interval before the relist loop is considered wedged
+	relistGracePeriod = 1 * time.Minute
+
+	// relistRetryInterval is the delay before retrying a failed relist, doubled on every consecutive failure
+	// up to the update interval
+	relistRetryInterval = 10 * time.Second
+
+	// defaultRemovalThreshold is the number of consecutive lists missing a custom metric before it is removed
+	defaultRemovalThreshold = 3
+)
+
 type MetricsLister interface {
 	Run()
 	RunUntil(stopChan <-chan struct{})
 	ListCustomMetrics() []provider.CustomMetricInfo
 	ListExternalMetrics() []provider.ExternalMetricInfo
+	// HasSynced returns true once the list of custom metrics has been loaded from Wavefront
+	HasSynced() bool
+	// CheckRelist returns an error if the relist loop has not completed an update in time
+	CheckRelist() error
+	// ResolveCustomMetric returns the Wavefront metric an exposed custom metric is sourced from, false if it is filtered out
+	ResolveCustomMetric(info provider.CustomMetricInfo) (CustomMetricSource, bool)
 }
 
 type ExternalConfigListener interface {
@@ -28,20 +53,58 @@ type ExternalConfigListener interface {
 }
 
 type WavefrontMetricsLister struct {
-	Prefix          string
-	UpdateInterval  time.Duration
-	waveClient      wave.WavefrontClient
-	externalDriver  ExternalMetricsDriver
-	customMetrics   []provider.CustomMetricInfo
-	externalMetrics []provider.ExternalMetricInfo
-	lock            sync.RWMutex
+	Prefix         string
+	UpdateInterval time.Duration
+	// RemovalThreshold is the number of consecutive successful lists a custom metric
+	// must be missing from before it is removed, defaults to 3
+	RemovalThreshold int
+	waveClient       wave.WavefrontClient
+	externalDriver   ExternalMetricsDriver
+	customMetrics    []provider.CustomMetricInfo
+	externalMetrics  []provider.ExternalMetricInfo
+	lock             sync.RWMutex
+	// updateLock serializes updates, which only hold the lock above to swap in their results
+	updateLock sync.Mutex
+	// changed holds a pending configuration change, applied in the background by applyConfigChanges
+	changed chan struct{}
+
+	// raw names of the listed custom metrics and the number of consecutive lists each has been missing from
+	customNames map[string]int
+	// sources of the exposed custom metrics keyed by resource and exposed name
+	customSources map[string]CustomMetricSource
+	// staleSince is the time of the first failed relist since the last successful one
+	staleSince time.Time
+
+	// progress of the relist loop, guarded by its own lock
+	stateLock  sync.Mutex
+	synced     bool
+	started    time.Time
+	lastUpdate time.Time
 
 	Translator
 }
 
+// configChanged schedules a refresh of the metrics without waiting for it, so that informers never block on Wavefront.
+// Changes made while a refresh is pending are applied by that same refresh.
 func (l *WavefrontMetricsLister) configChanged() {
-	log.Info("configuration changed. updating metrics.")
-	l.updateMetrics()
+	select {
+	case l.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (l *WavefrontMetricsLister) applyConfigChanges(stopChan <-chan struct{}) {
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-l.changed:
+			log.Info("configuration changed. updating metrics.")
+			if err := l.refreshMetrics(); err != nil {
+				log.Errorf("error updating external metrics: %v", err)
+			}
+		}
+	}
 }
 
 func (l *WavefrontMetricsLister) Run() {
@@ -50,18 +113,95 @@ func (l *WavefrontMetricsLister) Run() {
 
 func (l *WavefrontMetricsLister) RunUntil(stopChan <-chan struct{}) {
 	// register with external driver for config changes
+	l.changed = make(chan struct{}, 1)
+	go l.applyConfigChanges(stopChan)
 	l.externalDriver.registerListener(l)
 
-	go wait.Until(func() {
+	l.stateLock.Lock()
+	l.started = time.Now()
+	l.stateLock.Unlock()
+
+	go l.relist(stopChan)
+}
+
+// relist updates the metrics every update interval. Failed lists of custom metrics
+// are retried with an exponential backoff well before the next interval.
+func (l *WavefrontMetricsLister) relist(stopChan <-chan struct{}) {
+	backoff := l.retryBackoff()
+	for {
 		if err := l.updateMetrics(); err != nil {
 			log.Errorf("error updating metrics: %v", err)
 		}
-	}, l.UpdateInterval, stopChan)
+		l.stateLock.Lock()
+		l.lastUpdate = time.Now()
+		l.stateLock.Unlock()
+
+		delay := l.UpdateInterval
+		if l.isStale() {
+			delay = backoff.Step()
+			log.Infof("retrying to list custom metrics in %s", delay)
+		} else {
+			backoff = l.retryBackoff()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-stopChan:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (l *WavefrontMetricsLister) retryBackoff() wait.Backoff {
+	initial := relistRetryInterval
+	if l.UpdateInterval > 0 && l.UpdateInterval < initial {
+		initial = l.UpdateInterval
+	}
+	return wait.Backoff{
+		Duration: initial,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    math.MaxInt32,
+		Cap:      l.UpdateInterval,
+	}
+}
+
+func (l *WavefrontMetricsLister) isStale() bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return !l.staleSince.IsZero()
+}
+
+func (l *WavefrontMetricsLister) HasSynced() bool {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	return l.synced
+}
+
+func (l *WavefrontMetricsLister) CheckRelist() error {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+
+	if l.started.IsZero() || l.UpdateInterval <= 0 {
+		return nil
+	}
+	last := l.lastUpdate
+	if last.IsZero() {
+		last = l.started
+	}
+	if deadline := 2*l.UpdateInterval + relistGracePeriod; time.Since(last) > deadline {
+		return fmt.Errorf("metrics have not been relisted since %s", last.Format(time.RFC3339))
+	}
+	return nil
 }
 
+// updateMetrics lists the custom and external metrics. Requests to Wavefront are made without holding the lock
+// of the lister, so that serving requests is never blocked on them.
 func (l *WavefrontMetricsLister) updateMetrics() error {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
 	customErr := l.updateCustomMetrics()
 	externalErr := l.updateExternalMetrics()
 
@@ -71,24 +211,260 @@ func (l *WavefrontMetricsLister) updateMetrics() error {
 	return nil
 }
 
+// refreshMetrics applies a configuration change: the external metrics are listed again and the custom metrics are exposed
+// again from their last list. Custom metrics are only listed, and missing ones only removed, by the relist loop.
+func (l *WavefrontMetricsLister) refreshMetrics() error {
+	l.updateLock.Lock()
+	defer l.updateLock.Unlock()
+	prefixes := l.prefixes()
+
+	l.lock.Lock()
+	if l.customNames != nil {
+		l.customMetrics = l.exposeCustomMetrics(prefixes, l.knownCustomNames())
+	}
+	l.lock.Unlock()
+	return l.updateExternalMetrics()
+}
+
+// updateCustomMetrics lists the custom metrics under every prefix from Wavefront. On failure the previous list
+// is kept and marked stale. Metrics are only removed once missing from RemovalThreshold consecutive lists.
 func (l *WavefrontMetricsLister) updateCustomMetrics() error {
-	metrics, err := l.waveClient.ListMetrics(l.Prefix + ".*")
+	now := time.Now()
+	prefixes := l.prefixes()
+	metrics, err := l.listPrefixes(prefixes)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	if err != nil {
-		log.Errorf("error retrieving list of custom metrics from Wavefront: %v", err)
-		l.customMetrics = []provider.CustomMetricInfo{}
+		if l.staleSince.IsZero() {
+			l.staleSince = now
+		}
+		customMetricsListErrors.Inc()
+		customMetricsStaleSeconds.Set(now.Sub(l.staleSince).Seconds())
+		log.Errorf("error retrieving list of custom metrics from Wavefront, keeping the list from before %s: %v",
+			l.staleSince.Format(time.RFC3339), err)
 		return err
 	}
-	l.customMetrics = l.CustomMetricsFor(metrics)
+	if !l.staleSince.IsZero() {
+		log.Infof("listed custom metrics again after %s", now.Sub(l.staleSince).Round(time.Second))
+	}
+	l.staleSince = time.Time{}
+	customMetricsStaleSeconds.Set(0)
+
+	l.customMetrics = l.exposeCustomMetrics(prefixes, l.mergeCustomNames(metrics))
+
+	l.stateLock.Lock()
+	l.synced = true
+	l.stateLock.Unlock()
 	return nil
 }
 
+// prefixes returns the prefix of the lister followed by the configured prefixes other than the prefix of the lister
+func (l *WavefrontMetricsLister) prefixes() []config.MetricPrefix {
+	prefixes := []config.MetricPrefix{{Prefix: l.Prefix}}
+	if l.externalDriver == nil {
+		return prefixes
+	}
+	for _, prefix := range l.externalDriver.getMetricPrefixes() {
+		if prefix.Prefix != l.Prefix {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+func (l *WavefrontMetricsLister) listPrefixes(prefixes []config.MetricPrefix) ([]string, error) {
+	var metrics []string
+	for _, prefix := range prefixes {
+		listed, err := l.waveClient.ListMetrics(prefix.Prefix + ".*")
+		if err != nil {
+			return nil, fmt.Errorf("prefix %s: %w", prefix.Prefix, err)
+		}
+		metrics = append(metrics, listed...)
+	}
+	return metrics, nil
+}
+
+// exposeCustomMetrics filters and renames the listed custom metrics as configured. Must be called with the lock held. Each metric is sourced
+// from the most specific prefix it is listed under. If several metrics of a resource are exposed under
+// the same name, the metric of the first prefix in order wins, then the first metric in alphabetical order.
+func (l *WavefrontMetricsLister) exposeCustomMetrics(prefixes []config.MetricPrefix, names []string) []provider.CustomMetricInfo {
+	byPrefix := make(map[string][]string, len(prefixes))
+	for _, name := range names {
+		if prefix, found := prefixFor(prefixes, name); found {
+			byPrefix[prefix.Prefix] = append(byPrefix[prefix.Prefix], name)
+		}
+	}
+
+	mapper := l.customMapper()
+	sources := make(map[string]CustomMetricSource, len(names))
+	exposed := make([]provider.CustomMetricInfo, 0, len(names))
+	for _, prefix := range prefixes {
+		for _, name := range byPrefix[prefix.Prefix] {
+			info, ok := customMetricFor(prefix, name)
+			if !ok {
+				continue
+			}
+			metric, ok := mapper.Map(info.GroupResource.Resource, info.Metric)
+			if !ok {
+				continue
+			}
+			key := customSourceKey(info.GroupResource.Resource, metric)
+			if source, found := sources[key]; found {
+				log.Warningf("custom metric %s collides with %s as %s of %s, ignoring it",
+					name, source.wavefrontName(resourceType(info.GroupResource.Resource)), metric, info.GroupResource.Resource)
+				continue
+			}
+			sources[key] = CustomMetricSource{
+				Prefix:     prefix,
+				Metric:     info.Metric,
+				Conversion: mapper.Conversion(info.GroupResource.Resource, info.Metric),
+			}
+			info.Metric = metric
+			exposed = append(exposed, info)
+		}
+	}
+	l.customSources = sources
+	return exposed
+}
+
+func (l *WavefrontMetricsLister) customMapper() *config.CustomMetricsMapper {
+	if l.externalDriver == nil {
+		return nil
+	}
+	return l.externalDriver.getCustomMetricsMapper()
+}
+
+func customSourceKey(resource, metric string) string {
+	return resource + "/" + metric
+}
+
+// ResolveCustomMetric returns the Wavefront metric the listed custom metric of the given name is sourced from.
+// Metrics not listed yet are sourced from the prefix of the lister as long as the configuration neither filters
+// nor renames them.
+func (l *WavefrontMetricsLister) ResolveCustomMetric(info provider.CustomMetricInfo) (CustomMetricSource, bool) {
+	l.lock.RLock()
+	source, found := l.customSources[customSourceKey(info.GroupResource.Resource, info.Metric)]
+	l.lock.RUnlock()
+	if found {
+		return source, true
+	}
+	mapper := l.customMapper()
+	name, ok := mapper.Map(info.GroupResource.Resource, info.Metric)
+	if !ok || name != info.Metric {
+		return CustomMetricSource{}, false
+	}
+	return CustomMetricSource{
+		Prefix:     config.MetricPrefix{Prefix: l.Prefix},
+		Metric:     info.Metric,
+		Conversion: mapper.Conversion(info.GroupResource.Resource, info.Metric),
+	}, true
+}
+
 func (l *WavefrontMetricsLister) updateExternalMetrics() error {
-	if l.externalDriver != nil {
-		l.externalMetrics = l.ExternalMetricsFor(l.externalDriver.getMetricNames())
+	if l.externalDriver == nil {
+		return nil
+	}
+	names := l.externalDriver.getMetricNames()
+	var errs []string
+	for _, pattern := range l.externalDriver.getPatterns() {
+		if pattern.Restricted() {
+			continue
+		}
+		names = append(names, pattern.Names...)
+		discovered, err := l.discoverNames(pattern)
+		if err != nil {
+			log.Errorf("error discovering external metrics for pattern %s: %v", pattern.Pattern, err)
+			errs = append(errs, err.Error())
+		}
+		names = append(names, discovered...)
+	}
+	externalMetrics := l.ExternalMetricsFor(uniqueSorted(names))
+
+	l.lock.Lock()
+	l.externalMetrics = externalMetrics
+	l.lock.Unlock()
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
 	}
 	return nil
 }
 
+// discoverNames returns the metric names exposed for every value the discovery tag takes
+// across the series returned by the discovery query of the pattern.
+func (l *WavefrontMetricsLister) discoverNames(pattern config.PatternRule) ([]string, error) {
+	if pattern.Discovery == nil {
+		return nil, nil
+	}
+	start := time.Now().Add(-patternDiscoveryWindow)
+	result, err := l.waveClient.Query(start.Unix(), pattern.Discovery.Query)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, timeseries := range result.Timeseries {
+		value, found := timeseries.Tags[pattern.Discovery.Tag]
+		if !found {
+			continue
+		}
+		if name, ok := pattern.DiscoveredName(value); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// mergeCustomNames merges the listed names into the known names and returns the names to expose.
+func (l *WavefrontMetricsLister) mergeCustomNames(listed []string) []string {
+	threshold := l.RemovalThreshold
+	if threshold <= 0 {
+		threshold = defaultRemovalThreshold
+	}
+	if l.customNames == nil {
+		l.customNames = make(map[string]int, len(listed))
+	}
+
+	present := make(map[string]bool, len(listed))
+	for _, name := range listed {
+		present[name] = true
+		l.customNames[name] = 0
+	}
+	for name := range l.customNames {
+		if present[name] {
+			continue
+		}
+		l.customNames[name]++
+		if l.customNames[name] >= threshold {
+			log.Debugf("removing custom metric %s missing from %d consecutive lists", name, threshold)
+			delete(l.customNames, name)
+		}
+	}
+	return l.knownCustomNames()
+}
+
+// knownCustomNames returns the listed custom metric names which have not been removed yet, in order.
+func (l *WavefrontMetricsLister) knownCustomNames() []string {
+	names := make([]string, 0, len(l.customNames))
+	for name := range l.customNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func uniqueSorted(values []string) []string {
+	unique := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if !unique[value] {
+			unique[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 func (l *WavefrontMetricsLister) ListCustomMetrics() []provider.CustomMetricInfo {
 	l.lock.RLock()
 	defer l.lock.RUnlock()
@@ -0,0 +1,282 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+)
+
+// listClient returns the next configured list of metrics on every call, nil fails the call
+type listClient struct {
+	client.WavefrontClient
+	lists [][]string
+}
+
+func (c *listClient) ListMetrics(prefix string) ([]string, error) {
+	list := c.lists[0]
+	c.lists = c.lists[1:]
+	if list == nil {
+		return nil, &client.Error{Type: client.ErrUnavailable, Msg: "connection refused"}
+	}
+	return list, nil
+}
+
+// blockingClient signals every list of metrics and only returns once released
+type blockingClient struct {
+	client.WavefrontClient
+	listing chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingClient) ListMetrics(prefix string) ([]string, error) {
+	c.listing <- struct{}{}
+	<-c.release
+	return []string{"kubernetes.pod.cpu.usage"}, nil
+}
+
+func customMetricNames(l *WavefrontMetricsLister) []string {
+	var names []string
+	for _, info := range l.ListCustomMetrics() {
+		names = append(names, fmt.Sprintf("%s/%s", info.GroupResource.Resource, info.Metric))
+	}
+	return names
+}
+
+func TestRelistKeepsLastKnownMetrics(t *testing.T) {
+	cpu, memory := "kubernetes.pod.cpu.usage", "kubernetes.pod.memory.usage"
+	lister := &WavefrontMetricsLister{
+		Prefix:           "kubernetes",
+		RemovalThreshold: 2,
+		waveClient: &listClient{lists: [][]string{
+			{cpu, memory},
+			nil,
+			{cpu},
+			{cpu, memory},
+			{cpu},
+			{cpu},
+		}},
+		externalDriver: &fakeExternalDriver{},
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+
+	assert.NoError(t, lister.updateMetrics())
+	assert.Equal(t, []string{"pods/cpu.usage", "pods/memory.usage"}, customMetricNames(lister))
+	assert.False(t, lister.isStale())
+
+	// a failed list keeps the previous metrics
+	assert.Error(t, lister.updateMetrics())
+	assert.Equal(t, []string{"pods/cpu.usage", "pods/memory.usage"}, customMetricNames(lister))
+	assert.True(t, lister.isStale())
+
+	// missing once, then listed again
+	assert.NoError(t, lister.updateMetrics())
+	assert.False(t, lister.isStale())
+	assert.Equal(t, []string{"pods/cpu.usage", "pods/memory.usage"}, customMetricNames(lister))
+	assert.NoError(t, lister.updateMetrics())
+	assert.Equal(t, []string{"pods/cpu.usage", "pods/memory.usage"}, customMetricNames(lister))
+
+	// removed once missing from two consecutive lists
+	assert.NoError(t, lister.updateMetrics())
+	assert.Equal(t, []string{"pods/cpu.usage", "pods/memory.usage"}, customMetricNames(lister))
+	assert.NoError(t, lister.updateMetrics())
+	assert.Equal(t, []string{"pods/cpu.usage"}, customMetricNames(lister))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	lister := &WavefrontMetricsLister{UpdateInterval: time.Minute}
+	backoff := lister.retryBackoff()
+	var delays []time.Duration
+	for i := 0; i < 6; i++ {
+		delays = append(delays, backoff.Step())
+	}
+	assert.True(t, delays[0] < 2*relistRetryInterval)
+	for _, delay := range delays {
+		assert.True(t, delay <= time.Minute+time.Minute/10, delay)
+	}
+	assert.True(t, delays[5] >= time.Minute)
+
+	lister.UpdateInterval = time.Second
+	backoff = lister.retryBackoff()
+	assert.True(t, backoff.Step() < 2*time.Second)
+}
+
+func TestCustomMetricsFilterAndRename(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	driver.setCustomMetrics(&config.CustomMetricsConfig{
+		Filters: []config.MetricFilter{
+			{Exclude: []string{`.*\.debug\..*`}},
+			{Resource: "nodes", Include: []string{`cpu\..*`}},
+		},
+		Renames: []config.MetricRename{
+			{Resource: "pods", Match: `cpu\.usage_rate`, As: "cpu_usage"},
+			{Resource: "pods", Match: `cpu\.(usage)`, As: "cpu_${1}"},
+		},
+		Conversions: []config.MetricConversion{
+			{Match: `memory\..*`, Conversion: config.Conversion{Unit: config.UnitBytes}},
+		},
+	})
+	lister := &WavefrontMetricsLister{
+		Prefix: "kubernetes",
+		waveClient: &listClient{lists: [][]string{{
+			"kubernetes.node.cpu.usage_rate",
+			"kubernetes.node.memory.usage",
+			"kubernetes.pod.cpu.usage",
+			"kubernetes.pod.cpu.usage_rate",
+			"kubernetes.pod.net.debug.drops",
+			"kubernetes.pod.memory.usage",
+		}}},
+		externalDriver: driver,
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+
+	assert.NoError(t, lister.updateMetrics())
+	// cpu.usage_rate collides with cpu.usage once renamed, the first in order wins
+	assert.Equal(t, []string{"nodes/cpu.usage_rate", "pods/cpu_usage", "pods/memory.usage"}, customMetricNames(lister))
+
+	pods := schema.GroupResource{Resource: "pods"}
+	nodes := schema.GroupResource{Resource: "nodes"}
+	for _, test := range []struct {
+		info     provider.CustomMetricInfo
+		expected string
+		found    bool
+	}{
+		{provider.CustomMetricInfo{GroupResource: pods, Metric: "cpu_usage"}, "cpu.usage", true},
+		{provider.CustomMetricInfo{GroupResource: pods, Metric: "memory.usage"}, "memory.usage", true},
+		// not listed yet but neither filtered nor renamed
+		{provider.CustomMetricInfo{GroupResource: pods, Metric: "disk.usage"}, "disk.usage", true},
+		{provider.CustomMetricInfo{GroupResource: pods, Metric: "cpu.usage"}, "", false},
+		{provider.CustomMetricInfo{GroupResource: pods, Metric: "net.debug.drops"}, "", false},
+		{provider.CustomMetricInfo{GroupResource: nodes, Metric: "memory.usage"}, "", false},
+	} {
+		source, found := lister.ResolveCustomMetric(test.info)
+		assert.Equal(t, test.found, found, test.info.String())
+		assert.Equal(t, test.expected, source.Metric, test.info.String())
+	}
+
+	source, _ := lister.ResolveCustomMetric(provider.CustomMetricInfo{GroupResource: pods, Metric: "memory.usage"})
+	assert.Equal(t, config.UnitBytes, source.Conversion.Unit)
+}
+
+// prefixClient lists the configured metrics under each prefix
+type prefixClient struct {
+	client.WavefrontClient
+	metrics map[string][]string
+}
+
+func (c *prefixClient) ListMetrics(prefix string) ([]string, error) {
+	return c.metrics[prefix], nil
+}
+
+func TestCustomMetricsFromPrefixes(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	driver.setCustomMetrics(&config.CustomMetricsConfig{
+		Prefixes: []config.MetricPrefix{
+			{Prefix: "app", Resource: "pods", NameTag: "pod", NamespaceTag: "ns"},
+			{Prefix: "app.web", Resource: "pods"},
+			{Prefix: "kubernetes", NameTag: "ignored"},
+		},
+	})
+	lister := &WavefrontMetricsLister{
+		Prefix: "kubernetes",
+		waveClient: &prefixClient{metrics: map[string][]string{
+			"kubernetes.*": {"kubernetes.pod.cpu.usage", "kubernetes.node.cpu.usage"},
+			"app.*":        {"app.cpu.usage", "app.http.requests", "app.web.latency"},
+			"app.web.*":    {"app.web.latency"},
+		}},
+		externalDriver: driver,
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+
+	assert.NoError(t, lister.updateMetrics())
+	// app.cpu.usage collides with kubernetes.pod.cpu.usage, the first prefix wins
+	assert.Equal(t, []string{"nodes/cpu.usage", "pods/cpu.usage", "pods/http.requests", "pods/latency"}, customMetricNames(lister))
+
+	pods := schema.GroupResource{Resource: "pods"}
+	source, found := lister.ResolveCustomMetric(provider.CustomMetricInfo{GroupResource: pods, Metric: "http.requests"})
+	assert.True(t, found)
+	assert.Equal(t, `ts(app.http.requests, (pod="pod1" or pod="pod2") and (ns="default"))`,
+		source.query("pod", "default", "pod1", "pod2"))
+
+	source, found = lister.ResolveCustomMetric(provider.CustomMetricInfo{GroupResource: pods, Metric: "latency"})
+	assert.True(t, found)
+	assert.Equal(t, `ts(app.web.latency, (pod_name="pod1") and (namespace_name="default"))`,
+		source.query("pod", "default", "pod1"))
+
+	source, found = lister.ResolveCustomMetric(provider.CustomMetricInfo{GroupResource: pods, Metric: "cpu.usage"})
+	assert.True(t, found)
+	assert.Equal(t, `ts(kubernetes.pod.cpu.usage, (pod_name="pod1") and (namespace_name="default"))`,
+		source.query("pod", "default", "pod1"))
+}
+
+func TestUpdateDoesNotBlockRequests(t *testing.T) {
+	waveClient := &blockingClient{listing: make(chan struct{}), release: make(chan struct{})}
+	lister := &WavefrontMetricsLister{
+		Prefix:         "kubernetes",
+		waveClient:     waveClient,
+		externalDriver: &fakeExternalDriver{},
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+	done := make(chan error)
+	go func() {
+		done <- lister.updateMetrics()
+	}()
+	<-waveClient.listing
+
+	// metrics are served while Wavefront is being listed
+	served := make(chan []string)
+	go func() {
+		served <- customMetricNames(lister)
+	}()
+	select {
+	case names := <-served:
+		assert.Empty(t, names)
+	case <-time.After(5 * time.Second):
+		t.Fatal("listing custom metrics blocked on the update")
+	}
+
+	close(waveClient.release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, []string{"pods/cpu.usage"}, customMetricNames(lister))
+}
+
+func TestConfigChangeOnlyRefreshes(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	lister := &WavefrontMetricsLister{
+		Prefix:           "kubernetes",
+		RemovalThreshold: 1,
+		// a second list would fail the test
+		waveClient:     &listClient{lists: [][]string{{"kubernetes.pod.cpu.usage", "kubernetes.pod.memory.usage"}}},
+		externalDriver: driver,
+		Translator:     NewWavefrontTranslator("kubernetes"),
+		changed:        make(chan struct{}, 1),
+	}
+	assert.NoError(t, lister.updateMetrics())
+	driver.registerListener(lister)
+
+	// changes never wait for the refresh, and a burst of changes is applied by a single refresh
+	for i := 0; i < 3; i++ {
+		driver.setRules(ruleSource{kind: hpaSourceKind, namespace: "default", name: fmt.Sprint(i)}, []config.MetricRule{{Name: "queue_depth", Query: "ts(queue.depth)"}})
+	}
+	driver.setRules(ruleSource{kind: fileSourceKind}, []config.MetricRule{{Name: "shared", Query: "ts(shared)"}})
+	driver.setCustomMetrics(&config.CustomMetricsConfig{
+		Renames: []config.MetricRename{{Resource: "pods", Match: `cpu\.usage`, As: "cpu"}},
+	})
+	assert.Len(t, lister.changed, 1)
+
+	// external metrics are listed again, custom metrics are exposed again without being listed nor removed
+	<-lister.changed
+	assert.NoError(t, lister.refreshMetrics())
+	assert.Equal(t, []string{"pods/cpu", "pods/memory.usage"}, customMetricNames(lister))
+	assert.Equal(t, []provider.ExternalMetricInfo{{Metric: "shared"}}, lister.ListExternalMetrics())
+}
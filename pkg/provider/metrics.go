@@ -0,0 +1,49 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const metricsNamespace = "wavefront_adapter"
+
+var (
+	externalConfigLoadErrors = metrics.NewCounter(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Name:           "external_config_load_errors_total",
+		Help:           "Number of failed attempts to load the external metrics configuration.",
+		StabilityLevel: metrics.ALPHA,
+	})
+	externalConfigValid = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Name:           "external_config_valid",
+		Help:           "Whether the last attempt to load the external metrics configuration succeeded (1) or not (0).",
+		StabilityLevel: metrics.ALPHA,
+	})
+	externalRuleConflicts = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Name:           "external_rule_conflicts",
+		Help:           "Number of external metric rule declarations ignored because another owner declares a different query.",
+		StabilityLevel: metrics.ALPHA,
+	})
+	customMetricsListErrors = metrics.NewCounter(&metrics.CounterOpts{
+		Namespace:      metricsNamespace,
+		Name:           "custom_metrics_list_errors_total",
+		Help:           "Number of failed attempts to list the custom metrics from Wavefront.",
+		StabilityLevel: metrics.ALPHA,
+	})
+	customMetricsStaleSeconds = metrics.NewGauge(&metrics.GaugeOpts{
+		Namespace:      metricsNamespace,
+		Name:           "custom_metrics_stale_seconds",
+		Help:           "Seconds since the first failed attempt to list the custom metrics, as of the last attempt. Zero while the list is up to date.",
+		StabilityLevel: metrics.ALPHA,
+	})
+)
+
+func init() {
+	legacyregistry.MustRegister(externalConfigLoadErrors, externalConfigValid, externalRuleConflicts,
+		customMetricsListErrors, customMetricsStaleSeconds)
+}
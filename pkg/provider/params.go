@@ -0,0 +1,93 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// requestParams returns the parameters available to a query for the given request:
+// the namespace, the cluster name and every label the metricSelector matches on a single value.
+func requestParams(namespace, cluster string, selector labels.Selector) map[string]string {
+	params := make(map[string]string)
+	if selector != nil {
+		requirements, _ := selector.Requirements()
+		for _, requirement := range requirements {
+			switch requirement.Operator() {
+			case selection.Equals, selection.DoubleEquals, selection.In:
+				if values := requirement.Values(); values.Len() == 1 {
+					params[requirement.Key()] = values.List()[0]
+				}
+			}
+		}
+	}
+	// built-in parameters take precedence over labels
+	params[config.NamespaceParam] = namespace
+	if cluster != "" {
+		params[config.ClusterParam] = cluster
+	}
+	return params
+}
+
+// expandQuery substitutes the escaped parameters for the placeholders of the rule query.
+func expandQuery(rule config.MetricRule, params map[string]string) (string, error) {
+	if err := checkParams(rule, params); err != nil {
+		return "", err
+	}
+	return substitute(rule.Query, params), nil
+}
+
+// expandQueries substitutes the escaped parameters for the placeholders of the queries of a composite rule.
+func expandQueries(rule config.MetricRule, params map[string]string) (map[string]string, error) {
+	if err := checkParams(rule, params); err != nil {
+		return nil, err
+	}
+	queries := make(map[string]string, len(rule.Queries))
+	for name, query := range rule.Queries {
+		queries[name] = substitute(query, params)
+	}
+	return queries, nil
+}
+
+// checkParams returns an error naming the parameters required by the rule which are missing from params.
+func checkParams(rule config.MetricRule, params map[string]string) error {
+	var missing []string
+	for _, param := range rule.Params {
+		if _, found := params[param]; !found {
+			missing = append(missing, param)
+		}
+	}
+	for _, query := range rule.AllQueries() {
+		for _, param := range config.Placeholders(query) {
+			if _, found := params[param]; !found && !contains(missing, param) {
+				missing = append(missing, param)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required parameters %v for external metric %s, provide them as metricSelector labels",
+			missing, rule.Name)
+	}
+	return nil
+}
+
+func substitute(query string, params map[string]string) string {
+	return config.ReplacePlaceholders(query, func(name string) string {
+		return config.EscapeValue(params[name])
+	})
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+func TestRequestParams(t *testing.T) {
+	selector, err := labels.Parse("queue=orders,region in (us-west),env in (dev,prod),tier!=web")
+	assert.NoError(t, err)
+
+	params := requestParams("shop", "prod-cluster", selector)
+	assert.Equal(t, map[string]string{
+		"namespace": "shop",
+		"cluster":   "prod-cluster",
+		"queue":     "orders",
+		"region":    "us-west",
+	}, params)
+
+	// built-in parameters cannot be overridden by labels
+	selector, _ = labels.Parse("namespace=other")
+	params = requestParams("shop", "", selector)
+	assert.Equal(t, map[string]string{"namespace": "shop"}, params)
+
+	assert.Equal(t, map[string]string{"namespace": "shop"}, requestParams("shop", "", nil))
+}
+
+func TestExpandQuery(t *testing.T) {
+	rule := config.MetricRule{
+		Name:   "queue-depth",
+		Query:  `ts(queue.depth, queue="${queue}" and namespace="${namespace}" and cluster="${cluster}")`,
+		Params: []string{"queue"},
+	}
+
+	query, err := expandQuery(rule, map[string]string{"queue": "orders", "namespace": "shop", "cluster": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, `ts(queue.depth, queue="orders" and namespace="shop" and cluster="prod")`, query)
+
+	// values cannot break out of the quoted string
+	query, err = expandQuery(rule, map[string]string{"queue": `a" or queue="*`, "namespace": "shop", "cluster": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, `ts(queue.depth, queue="a\" or queue=\"*" and namespace="shop" and cluster="prod")`, query)
+
+	_, err = expandQuery(rule, map[string]string{"namespace": "shop"})
+	assert.EqualError(t, err, "missing required parameters [queue cluster] for external metric queue-depth, provide them as metricSelector labels")
+
+	// queries without placeholders are unchanged
+	query, err = expandQuery(config.MetricRule{Name: "plain", Query: `ts(a, tag="${")`}, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, `ts(a, tag="${")`, query)
+}
+
+func TestValidateParams(t *testing.T) {
+	rule := config.MetricRule{Name: "queue-depth", Query: `ts(queue.depth, queue="${queue}", namespace="${namespace}")`}
+	assert.EqualError(t, rule.Validate(), `undeclared parameter "queue" in query for rule: queue-depth`)
+
+	rule.Params = []string{"queue"}
+	assert.NoError(t, rule.Validate())
+}
+
+func TestAnnotationParams(t *testing.T) {
+	rules := rulesFromAnnotations(map[string]string{
+		"wavefront.com.external.metric/queue_depth": `ts(queue.depth, queue="${queue}" and alt="${queue}" and namespace="${namespace}")`,
+	})
+	assert.Equal(t, []string{"queue"}, rules[0].Params)
+	assert.NoError(t, rules[0].Validate())
+
+	query, err := expandQuery(rules[0], map[string]string{"queue": "orders", "namespace": "shop"})
+	assert.NoError(t, err)
+	assert.Equal(t, `ts(queue.depth, queue="orders" and alt="orders" and namespace="shop")`, query)
+	_, err = expandQuery(rules[0], map[string]string{"namespace": "shop"})
+	assert.EqualError(t, err, "missing required parameters [queue] for external metric queue_depth, provide them as metricSelector labels")
+}
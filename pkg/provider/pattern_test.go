@@ -0,0 +1,121 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+func TestPatternRules(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	source := ruleSource{kind: fileSourceKind, name: "config.yaml"}
+	driver.setRules(source, []config.MetricRule{{Name: "sqs_depth_special", Query: "ts(special.depth)"}})
+	driver.setPatterns(source, compiled(t,
+		config.PatternRule{Pattern: "sqs_depth_(.+)", Query: `ts(aws.sqs.depth, QueueName="${1}")`, Reduction: config.ReductionMax},
+		config.PatternRule{Pattern: "sqs_(.+)", Query: "ts(unreachable)"},
+	))
+
+	rule, found := driver.getRule("default", "sqs_depth_orders")
+	assert.True(t, found)
+	assert.Equal(t, "sqs_depth_orders", rule.Name)
+	assert.Equal(t, `ts(aws.sqs.depth, QueueName="orders")`, rule.Query)
+	assert.Equal(t, config.ReductionMax, rule.Reduction)
+
+	// captures are escaped
+	rule, _ = driver.getRule("default", `sqs_depth_a"b`)
+	assert.Equal(t, `ts(aws.sqs.depth, QueueName="a\"b")`, rule.Query)
+	// captures cannot add placeholders expanded from the parameters of the request
+	_, found = driver.getRule("default", "sqs_depth_${namespace}")
+	assert.False(t, found)
+
+	// rules take precedence over patterns
+	assert.Equal(t, "ts(special.depth)", queryOf(driver, "default", "sqs_depth_special"))
+
+	// the pattern must match the entire name
+	_, found = driver.getRule("default", "queue_depth")
+	assert.False(t, found)
+
+	driver.setPatterns(source, nil)
+	_, found = driver.getRule("default", "sqs_depth_orders")
+	assert.False(t, found)
+}
+
+// compiled compiles the patterns as loading the configuration does.
+func compiled(t *testing.T, patterns ...config.PatternRule) []config.PatternRule {
+	for i := range patterns {
+		assert.NoError(t, patterns[i].Compile())
+	}
+	return patterns
+}
+
+func TestValidatePattern(t *testing.T) {
+	pattern := config.PatternRule{Pattern: "sqs_depth_(.+)", Query: `ts(aws.sqs.depth, QueueName="${1}")`}
+	assert.NoError(t, pattern.Validate())
+
+	invalid := pattern
+	invalid.Pattern = "sqs_depth_("
+	assert.Error(t, invalid.Validate())
+
+	invalid = pattern
+	invalid.Query = `ts(aws.sqs.depth, QueueName="${2}")`
+	assert.EqualError(t, invalid.Validate(), "query references missing capture ${2} for pattern: sqs_depth_(.+)")
+
+	invalid = pattern
+	invalid.Names = []string{"queue_depth"}
+	assert.EqualError(t, invalid.Validate(), `name "queue_depth" does not match pattern: sqs_depth_(.+)`)
+
+	invalid = pattern
+	invalid.Reduction = "median"
+	assert.Error(t, invalid.Validate())
+
+	// invalid patterns are rejected when the configuration is loaded
+	_, err := config.FromYAML([]byte("patterns:\n- pattern: sqs_depth_(\n  query: ts(aws.sqs.depth)\n"))
+	assert.Error(t, err)
+	cfg, err := config.FromYAML([]byte("patterns:\n- pattern: sqs_depth_(.+)\n  query: ts(aws.sqs.depth)\n"))
+	assert.NoError(t, err)
+	_, found := cfg.Patterns[0].Match("sqs_depth_orders")
+	assert.True(t, found)
+}
+
+func TestPatternDiscovery(t *testing.T) {
+	driver := newWavefrontExternalDriver()
+	driver.setPatterns(ruleSource{kind: fileSourceKind}, compiled(t, config.PatternRule{
+		Pattern: "pod_load_(.+)",
+		Query:   `ts(pod.load, pod_name="${1}")`,
+		Names:   []string{"pod_load_static"},
+		Discovery: &config.TagDiscovery{
+			Query: "ts(pod.load)",
+			Tag:   "pod_name",
+			Name:  "pod_load_${1}",
+		},
+	}))
+
+	lister := &WavefrontMetricsLister{
+		waveClient:     client.NewFakeWavefrontClient(),
+		externalDriver: driver,
+		Translator:     NewWavefrontTranslator("kubernetes"),
+	}
+	assert.NoError(t, lister.updateExternalMetrics())
+
+	var names []string
+	for _, info := range lister.ListExternalMetrics() {
+		names = append(names, info.Metric)
+	}
+	assert.Equal(t, []string{
+		"pod_load_static",
+		"pod_load_test-deployment-7f54684694-2cg5v",
+		"pod_load_test-deployment-7f54684694-cbts9",
+		"pod_load_test-deployment-7f54684694-mm49g",
+		"pod_load_test-deployment-7f54684694-t57tb",
+		"pod_load_test-deployment-7f54684694-xnxfp",
+	}, names)
+
+	_, found := driver.getPatterns()[0].DiscoveredName("${namespace}")
+	assert.False(t, found)
+}
@@ -12,12 +12,12 @@ import (
 
 	apierr "k8s.io/apimachinery/pkg/api/errors"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
@@ -25,14 +25,19 @@ import (
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider/helpers"
 
 	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 )
 
+const defaultQueryWindow = 30 * time.Second
+
 type wavefrontProvider struct {
 	mapper         apimeta.RESTMapper
 	dynClient      dynamic.Interface
 	waveClient     wave.WavefrontClient
 	lister         MetricsLister
 	externalDriver ExternalMetricsDriver
+	clusterName    string
+	prefix         string
 
 	Translator
 }
@@ -40,27 +45,54 @@ type wavefrontProvider struct {
 var _ provider.MetricsProvider = &wavefrontProvider{}
 
 type WavefrontProviderConfig struct {
-	DynClient    dynamic.Interface
-	KubeClient   kubernetes.Interface
-	Mapper       apimeta.RESTMapper
-	WaveClient   wave.WavefrontClient
-	Prefix       string
-	ListInterval time.Duration
-	ExternalCfg  string
+	DynClient  dynamic.Interface
+	KubeClient kubernetes.Interface
+	Mapper     apimeta.RESTMapper
+	// MetadataClient lists the objects of AnnotatedKinds other than HPAs
+	MetadataClient metadata.Interface
+	WaveClient     wave.WavefrontClient
+	Prefix         string
+	ListInterval   time.Duration
+	// RemovalThreshold is the number of consecutive lists a custom metric must be missing from before it is removed
+	RemovalThreshold int
+	ExternalCfg      string
+	// ExternalCfgMap is the external config map of the form namespace/name[/key]
+	ExternalCfgMap string
+	// FailOnInvalidExternalCfg makes an invalid external config fatal on startup
+	FailOnInvalidExternalCfg bool
+	// WatchExternalMetricCRDs enables WavefrontExternalMetric objects as a source of external rules
+	WatchExternalMetricCRDs bool
+	// ClusterName is substituted for ${cluster} within external rule queries
+	ClusterName string
+	// AnnotatedKinds are the kinds whose annotations declare external rules, defaults to HPAs only
+	AnnotatedKinds []string
+	// StopCh stops the background discovery of external rules once closed
+	StopCh <-chan struct{}
 }
 
 func NewWavefrontProvider(cfg WavefrontProviderConfig) (provider.MetricsProvider, MetricsLister) {
 	log.Infof("wavefrontProvider Prefix: %s, ListInterval: %d", cfg.Prefix, cfg.ListInterval)
 
 	translator := NewWavefrontTranslator(cfg.Prefix)
-	externalDriver := NewExternalMetricsDriver(cfg.KubeClient, cfg.ExternalCfg)
+	externalDriver := NewExternalMetricsDriver(ExternalDriverConfig{
+		KubeClient:          cfg.KubeClient,
+		DynClient:           cfg.DynClient,
+		MetadataClient:      cfg.MetadataClient,
+		ConfigFile:          cfg.ExternalCfg,
+		ConfigMap:           cfg.ExternalCfgMap,
+		FailOnInvalidConfig: cfg.FailOnInvalidExternalCfg,
+		WatchCRDs:           cfg.WatchExternalMetricCRDs,
+		AnnotatedKinds:      cfg.AnnotatedKinds,
+		StopCh:              cfg.StopCh,
+	})
 
 	lister := &WavefrontMetricsLister{
-		Prefix:         cfg.Prefix,
-		UpdateInterval: cfg.ListInterval,
-		waveClient:     cfg.WaveClient,
-		externalDriver: externalDriver,
-		Translator:     translator,
+		Prefix:           cfg.Prefix,
+		UpdateInterval:   cfg.ListInterval,
+		RemovalThreshold: cfg.RemovalThreshold,
+		waveClient:       cfg.WaveClient,
+		externalDriver:   externalDriver,
+		Translator:       translator,
 	}
 
 	return &wavefrontProvider{
@@ -69,22 +101,32 @@ func NewWavefrontProvider(cfg WavefrontProviderConfig) (provider.MetricsProvider
 		waveClient:     cfg.WaveClient,
 		lister:         lister,
 		externalDriver: externalDriver,
+		clusterName:    cfg.ClusterName,
+		prefix:         cfg.Prefix,
 		Translator:     translator,
 	}, lister
 }
 
-func (p *wavefrontProvider) query(info provider.CustomMetricInfo, namespace string, names ...string) (wave.QueryResult, error) {
-	query, found := p.QueryFor(info, namespace, names...)
+// query returns the series of the custom metric for the named objects, along with the Wavefront metric it is sourced from.
+func (p *wavefrontProvider) query(info provider.CustomMetricInfo, namespace string, names ...string) (wave.QueryResult, CustomMetricSource, error) {
+	source, found := p.customSourceFor(info)
 	if !found {
-		return wave.QueryResult{}, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+		return wave.QueryResult{}, source, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	result, err := p.doQuery(source.query(resourceType(info.GroupResource.Resource), namespace, names...))
+	return result, source, err
+}
+
+// customSourceFor returns the Wavefront metric the exposed custom metric is sourced from.
+func (p *wavefrontProvider) customSourceFor(info provider.CustomMetricInfo) (CustomMetricSource, bool) {
+	if p.lister == nil {
+		return CustomMetricSource{Prefix: config.MetricPrefix{Prefix: p.prefix}, Metric: info.Metric}, true
 	}
-	return p.doQuery(query)
+	return p.lister.ResolveCustomMetric(info)
 }
 
 func (p *wavefrontProvider) doQuery(query string) (wave.QueryResult, error) {
-	now := time.Now()
-	start := now.Add(time.Duration(-30) * time.Second)
-	queryResult, err := p.waveClient.Query(start.Unix(), query)
+	queryResult, err := p.rawQuery(query, 0)
 	if err != nil {
 		log.Errorf("unable to fetch metrics from wavefront: %v", err)
 		// don't leak implementation details to the user
@@ -93,12 +135,27 @@ func (p *wavefrontProvider) doQuery(query string) (wave.QueryResult, error) {
 	return queryResult, nil
 }
 
-func (p *wavefrontProvider) metricFor(value float64, name types.NamespacedName, info provider.CustomMetricInfo) (*custom_metrics.MetricValue, error) {
+// rawQuery runs the given query over the window against Wavefront without masking any errors.
+// The window defaults to the last 30 seconds.
+func (p *wavefrontProvider) rawQuery(query string, window time.Duration) (wave.QueryResult, error) {
+	if window <= 0 {
+		window = defaultQueryWindow
+	}
+	start := time.Now().Add(-window)
+	return p.waveClient.Query(start.Unix(), query)
+}
+
+func (p *wavefrontProvider) metricFor(value float64, name types.NamespacedName, info provider.CustomMetricInfo, conversion config.Conversion) (*custom_metrics.MetricValue, error) {
 
 	objRef, err := helpers.ReferenceFor(p.mapper, name, info)
 	if err != nil {
 		return nil, err
 	}
+	quantity, err := quantityFor(value, conversion)
+	if err != nil {
+		log.Errorf("unable to convert custom metric %s for %s: %v", info.String(), name, err)
+		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+	}
 
 	return &custom_metrics.MetricValue{
 		DescribedObject: objRef,
@@ -106,25 +163,32 @@ func (p *wavefrontProvider) metricFor(value float64, name types.NamespacedName,
 			Name: info.Metric,
 		},
 		Timestamp: metav1.Now(),
-		Value:     *resource.NewMilliQuantity(int64(value*1000.0), resource.DecimalSI),
+		Value:     quantity,
 	}, nil
 }
 
-func (p *wavefrontProvider) metricsFor(queryResult wave.QueryResult, namespace string, info provider.CustomMetricInfo, names []string) (*custom_metrics.MetricValueList, error) {
+func (p *wavefrontProvider) metricsFor(queryResult wave.QueryResult, source CustomMetricSource, namespace string, info provider.CustomMetricInfo, names []string) (*custom_metrics.MetricValueList, error) {
 
-	values, found := p.MatchValuesToNames(queryResult, info.GroupResource)
+	tag := source.nameTag(resourceType(info.GroupResource.Resource))
+	values, found := matchValuesToNames(queryResult, tag)
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
 	log.Debugf("metricsFor values: %v", values)
 
-	res := make([]custom_metrics.MetricValue, len(names))
-	for i, name := range names {
-		value, err := p.metricFor(values[name], types.NamespacedName{Namespace: namespace, Name: name}, info)
+	// objects whose value is NaN or infinite are left out as missing data, objects without series are served 0
+	invalid := invalidNames(queryResult, tag)
+	res := make([]custom_metrics.MetricValue, 0, len(names))
+	for _, name := range names {
+		value, found := values[name]
+		if !found && invalid[name] {
+			continue
+		}
+		metric, err := p.metricFor(value, types.NamespacedName{Namespace: namespace, Name: name}, info, source.Conversion)
 		if err != nil {
 			return nil, err
 		}
-		res[i] = *value
+		res = append(res, *metric)
 	}
 
 	return &custom_metrics.MetricValueList{
@@ -133,7 +197,7 @@ func (p *wavefrontProvider) metricsFor(queryResult wave.QueryResult, namespace s
 }
 
 func (p *wavefrontProvider) getSingle(info provider.CustomMetricInfo, name types.NamespacedName) (*custom_metrics.MetricValue, error) {
-	queryResult, err := p.query(info, name.Namespace, name.Name)
+	queryResult, source, err := p.query(info, name.Namespace, name.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +206,7 @@ func (p *wavefrontProvider) getSingle(info provider.CustomMetricInfo, name types
 		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
 	}
 
-	namedValues, found := p.MatchValuesToNames(queryResult, info.GroupResource)
+	namedValues, found := matchValuesToNames(queryResult, source.nameTag(resourceType(info.GroupResource.Resource)))
 	if !found {
 		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
 	}
@@ -157,7 +221,7 @@ func (p *wavefrontProvider) getSingle(info provider.CustomMetricInfo, name types
 		log.Errorf("None of the results returned by when fetching metric %s for %q matched the resource name", info.String(), name)
 		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
 	}
-	return p.metricFor(resultValue, name, info)
+	return p.metricFor(resultValue, name, info, source.Conversion)
 }
 
 func (p *wavefrontProvider) getMultiple(info provider.CustomMetricInfo, namespace string, selector labels.Selector) (*custom_metrics.MetricValueList, error) {
@@ -168,11 +232,11 @@ func (p *wavefrontProvider) getMultiple(info provider.CustomMetricInfo, namespac
 	log.Debugf("resourceNames: %s", resourceNames)
 
 	// query Wavefront for points
-	queryResult, err := p.query(info, namespace, resourceNames...)
+	queryResult, source, err := p.query(info, namespace, resourceNames...)
 	if err != nil {
 		return nil, err
 	}
-	return p.metricsFor(queryResult, namespace, info, resourceNames)
+	return p.metricsFor(queryResult, source, namespace, info, resourceNames)
 }
 
 func (p *wavefrontProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValue, error) {
@@ -209,16 +273,37 @@ func (p *wavefrontProvider) GetExternalMetric(ctx context.Context, namespace str
 		return nil, apierr.NewInternalError(fmt.Errorf("missing external driver for external metric: %s", info.Metric))
 	}
 
-	query := p.externalDriver.getQuery(info.Metric)
-	if query == "" {
-		return nil, apierr.NewInternalError(fmt.Errorf("missing query for external metric: %s", info.Metric))
+	rule, found := p.externalDriver.getRule(namespace, info.Metric)
+	if !found {
+		return nil, apierr.NewNotFound(external_metrics.Resource(info.Metric), info.Metric)
+	}
+	if err := p.checkAccess(namespace, rule); err != nil {
+		return nil, err
 	}
 
-	queryResult, err := p.doQuery(query)
+	params := requestParams(namespace, p.clusterName, metricSelector)
+	if rule.Composite() {
+		return p.getCompositeMetric(namespace, rule, params)
+	}
+	query, err := expandQuery(rule, params)
 	if err != nil {
-		return nil, apierr.NewInternalError(fmt.Errorf("error fetching metrics for external metric: %s error=%v", info.Metric, err))
+		return nil, apierr.NewBadRequest(err.Error())
+	}
+
+	queryResult, err := p.rawQuery(query, rule.QueryWindow())
+	if err != nil {
+		log.Errorf("unable to fetch metrics from wavefront: %v", err)
+		p.externalDriver.evaluated(namespace, info.Metric, nil, err)
+		// don't leak implementation details to the user
+		return nil, apierr.NewInternalError(fmt.Errorf("error fetching metrics for external metric: %s", info.Metric))
+	}
+	values, err := p.ExternalValuesFor(queryResult, rule)
+	if err != nil {
+		p.externalDriver.evaluated(namespace, info.Metric, nil, &wave.Error{Type: wave.ErrBadData, Msg: err.Error()})
+		return nil, err
 	}
-	return p.ExternalValuesFor(queryResult, info.Metric)
+	p.externalDriver.evaluated(namespace, info.Metric, values, nil)
+	return values, nil
 }
 
 func (p *wavefrontProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
@@ -6,8 +6,10 @@ package provider
 import (
 	"context"
 	"fmt"
+	"math"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 
@@ -110,3 +112,19 @@ func fakeCustomMetricInfo() provider.CustomMetricInfo {
 		Metric:        "cpu.usage_rate",
 	}
 }
+
+func TestMetricsForInvalidValues(t *testing.T) {
+	result := client.QueryResult{Timeseries: []client.Timeseries{
+		{Tags: map[string]string{"pod_name": "pod1"}, Data: [][]float64{{1, 2}}},
+		{Tags: map[string]string{"pod_name": "pod2"}, Data: [][]float64{{1, math.NaN()}}},
+	}}
+	values, err := fakeProvider().(*wavefrontProvider).metricsFor(result, CustomMetricSource{}, "default", fakeCustomMetricInfo(), []string{"pod1", "pod2", "pod3"})
+	assert.NoError(t, err)
+
+	// the object with an invalid value is missing, the object without series is served 0
+	served := make(map[string]string)
+	for _, value := range values.Items {
+		served[value.DescribedObject.Name] = value.Value.String()
+	}
+	assert.Equal(t, map[string]string{"pod1": "2", "pod3": "0"}, served)
+}
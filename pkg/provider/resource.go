@@ -0,0 +1,297 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+const (
+	// resourceQueryWindow is how far back resource metrics are queried, covering at least one collection interval
+	resourceQueryWindow = 2 * time.Minute
+
+	// resourceMetricsWindow is the window reported with resource metrics, the default collection interval of the collector
+	resourceMetricsWindow = time.Minute
+
+	// the CPU usage in millicores and the memory working set in bytes reported by the Kubernetes Metrics Collector
+	cpuUsageMetric    = "cpu.usage_rate"
+	memoryUsageMetric = "memory.working_set"
+
+	podTag       = "pod_name"
+	containerTag = "container_name"
+)
+
+var (
+	podsResource  = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	nodesResource = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+)
+
+// ResourceMetricsProvider is implemented by providers serving the PodMetrics and NodeMetrics of the resource metrics API.
+type ResourceMetricsProvider interface {
+	// GetPodMetrics returns the metrics of the named pod, a NotFound error if none are available
+	GetPodMetrics(namespace, name string) (*metrics.PodMetrics, error)
+	// ListPodMetrics returns the metrics of the pods matching the selector within the namespace, all namespaces if empty
+	ListPodMetrics(namespace string, selector labels.Selector) ([]metrics.PodMetrics, error)
+	// GetNodeMetrics returns the metrics of the named node, a NotFound error if none are available
+	GetNodeMetrics(name string) (*metrics.NodeMetrics, error)
+	// ListNodeMetrics returns the metrics of the nodes matching the selector
+	ListNodeMetrics(selector labels.Selector) ([]metrics.NodeMetrics, error)
+}
+
+var _ ResourceMetricsProvider = &wavefrontProvider{}
+
+func (p *wavefrontProvider) GetPodMetrics(namespace, name string) (*metrics.PodMetrics, error) {
+	pods, err := p.podMetrics(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pods {
+		if pods[i].Name == name {
+			return &pods[i], nil
+		}
+	}
+	return nil, apierr.NewNotFound(metrics.Resource("pods"), name)
+}
+
+func (p *wavefrontProvider) ListPodMetrics(namespace string, selector labels.Selector) ([]metrics.PodMetrics, error) {
+	pods, err := p.listObjects(podsResource, namespace, selector)
+	if err != nil {
+		return nil, err
+	}
+	podMetrics, err := p.podMetrics(namespace)
+	if err != nil {
+		return nil, err
+	}
+	// only pods that still exist are served
+	result := make([]metrics.PodMetrics, 0, len(podMetrics))
+	for _, podMetric := range podMetrics {
+		if pods[objectKey(podMetric.Namespace, podMetric.Name)] {
+			result = append(result, podMetric)
+		}
+	}
+	return result, nil
+}
+
+func (p *wavefrontProvider) GetNodeMetrics(name string) (*metrics.NodeMetrics, error) {
+	nodes, err := p.nodeMetrics(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range nodes {
+		if nodes[i].Name == name {
+			return &nodes[i], nil
+		}
+	}
+	return nil, apierr.NewNotFound(metrics.Resource("nodes"), name)
+}
+
+func (p *wavefrontProvider) ListNodeMetrics(selector labels.Selector) ([]metrics.NodeMetrics, error) {
+	nodes, err := p.listObjects(nodesResource, "", selector)
+	if err != nil {
+		return nil, err
+	}
+	nodeMetrics, err := p.nodeMetrics()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]metrics.NodeMetrics, 0, len(nodeMetrics))
+	for _, nodeMetric := range nodeMetrics {
+		if nodes[objectKey("", nodeMetric.Name)] {
+			result = append(result, nodeMetric)
+		}
+	}
+	return result, nil
+}
+
+// podMetrics returns the metrics of the named pods within the namespace, of every pod if no names are given.
+// Only containers reporting both CPU and memory usage are included.
+func (p *wavefrontProvider) podMetrics(namespace string, names ...string) ([]metrics.PodMetrics, error) {
+	cpu, err := p.resourceQuery(p.containerSource(cpuUsageMetric).query("pod_container", namespace, names...))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := p.resourceQuery(p.containerSource(memoryUsageMetric).query("pod_container", namespace, names...))
+	if err != nil {
+		return nil, err
+	}
+	memoryPoints := lastPoints(memory, defaultNamespaceTag, podTag, containerTag)
+
+	pods := make(map[string]*metrics.PodMetrics)
+	var keys []string
+	for key, cpuPoint := range lastPoints(cpu, defaultNamespaceTag, podTag, containerTag) {
+		usage, ok := resourceUsage(key, cpuPoint, memoryPoints[key])
+		if !ok {
+			continue
+		}
+		parts := strings.SplitN(key, "/", 3)
+		podKey := objectKey(parts[0], parts[1])
+		pod, found := pods[podKey]
+		if !found {
+			pod = &metrics.PodMetrics{
+				ObjectMeta: metav1.ObjectMeta{Namespace: parts[0], Name: parts[1]},
+				Window:     metav1.Duration{Duration: resourceMetricsWindow},
+			}
+			pods[podKey] = pod
+			keys = append(keys, podKey)
+		}
+		pod.Containers = append(pod.Containers, metrics.ContainerMetrics{Name: parts[2], Usage: usage})
+		if timestamp := pointTime(cpuPoint); timestamp.After(pod.Timestamp.Time) {
+			pod.Timestamp = metav1.NewTime(timestamp)
+		}
+	}
+
+	result := make([]metrics.PodMetrics, 0, len(keys))
+	for _, key := range uniqueSorted(keys) {
+		pod := pods[key]
+		sortContainers(pod.Containers)
+		result = append(result, *pod)
+	}
+	return result, nil
+}
+
+// nodeMetrics returns the metrics of the named nodes, of every node if no names are given.
+func (p *wavefrontProvider) nodeMetrics(names ...string) ([]metrics.NodeMetrics, error) {
+	cpu, err := p.resourceQuery(p.nodeSource(cpuUsageMetric).query("node", "", names...))
+	if err != nil {
+		return nil, err
+	}
+	memory, err := p.resourceQuery(p.nodeSource(memoryUsageMetric).query("node", "", names...))
+	if err != nil {
+		return nil, err
+	}
+	nameTag := tagKey("node")
+	memoryPoints := lastPoints(memory, nameTag)
+
+	var result []metrics.NodeMetrics
+	cpuPoints := lastPoints(cpu, nameTag)
+	for _, name := range sortedKeys(cpuPoints) {
+		usage, ok := resourceUsage(name, cpuPoints[name], memoryPoints[name])
+		if !ok {
+			continue
+		}
+		result = append(result, metrics.NodeMetrics{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Timestamp:  metav1.NewTime(pointTime(cpuPoints[name])),
+			Window:     metav1.Duration{Duration: resourceMetricsWindow},
+			Usage:      usage,
+		})
+	}
+	return result, nil
+}
+
+func (p *wavefrontProvider) containerSource(metric string) CustomMetricSource {
+	return CustomMetricSource{Prefix: config.MetricPrefix{Prefix: p.prefix, NameTag: podTag}, Metric: metric}
+}
+
+func (p *wavefrontProvider) nodeSource(metric string) CustomMetricSource {
+	return CustomMetricSource{Prefix: config.MetricPrefix{Prefix: p.prefix}, Metric: metric}
+}
+
+func (p *wavefrontProvider) resourceQuery(query string) (wave.QueryResult, error) {
+	result, err := p.rawQuery(query, resourceQueryWindow)
+	if err != nil {
+		log.Errorf("unable to fetch resource metrics from wavefront: %v", err)
+		// don't leak implementation details to the user
+		return wave.QueryResult{}, apierr.NewInternalError(fmt.Errorf("unable to fetch metrics"))
+	}
+	return result, nil
+}
+
+// listObjects returns the keys of the objects of the resource matching the selector
+func (p *wavefrontProvider) listObjects(resource schema.GroupVersionResource, namespace string, selector labels.Selector) (map[string]bool, error) {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	list, err := p.dynClient.Resource(resource).Namespace(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(list.Items))
+	for _, item := range list.Items {
+		keys[objectKey(item.GetNamespace(), item.GetName())] = true
+	}
+	return keys, nil
+}
+
+// resourceUsage converts the CPU usage in millicores and the memory usage in bytes, false if either is invalid
+func resourceUsage(key string, cpuPoint, memoryPoint []float64) (corev1.ResourceList, bool) {
+	if memoryPoint == nil {
+		return nil, false
+	}
+	cpu, err := quantityFor(cpuPoint[1], config.Conversion{Unit: config.UnitMillicores})
+	if err != nil {
+		log.Warningf("ignoring CPU usage of %s: %v", key, err)
+		return nil, false
+	}
+	memory, err := quantityFor(memoryPoint[1], config.Conversion{Unit: config.UnitBytes})
+	if err != nil {
+		log.Warningf("ignoring memory usage of %s: %v", key, err)
+		return nil, false
+	}
+	return corev1.ResourceList{corev1.ResourceCPU: cpu, corev1.ResourceMemory: memory}, true
+}
+
+// lastPoints returns the last [timestamp, value] point of every series keyed by the values of the given tags
+// joined by slashes. Series missing any of the tags or data are skipped.
+func lastPoints(result wave.QueryResult, tags ...string) map[string][]float64 {
+	points := make(map[string][]float64, len(result.Timeseries))
+	for _, timeseries := range result.Timeseries {
+		length := len(timeseries.Data)
+		if length == 0 || len(timeseries.Data[length-1]) != 2 {
+			continue
+		}
+		values := make([]string, len(tags))
+		complete := true
+		for i, tag := range tags {
+			values[i], complete = timeseries.Tags[tag]
+			if !complete {
+				break
+			}
+		}
+		if complete {
+			points[strings.Join(values, "/")] = timeseries.Data[length-1]
+		}
+	}
+	return points
+}
+
+func pointTime(point []float64) time.Time {
+	return time.Unix(int64(point[0]), 0)
+}
+
+func objectKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func sortedKeys(points map[string][]float64) []string {
+	keys := make([]string, 0, len(points))
+	for key := range points {
+		keys = append(keys, key)
+	}
+	return uniqueSorted(keys)
+}
+
+func sortContainers(containers []metrics.ContainerMetrics) {
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+)
+
+// seriesClient returns the series of the first metric contained in the query
+type seriesClient struct {
+	client.WavefrontClient
+	series  map[string][]client.Timeseries
+	queries []string
+	lock    sync.Mutex
+}
+
+func (c *seriesClient) Query(start int64, query string) (client.QueryResult, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queries = append(c.queries, query)
+	for metric, series := range c.series {
+		if strings.Contains(query, metric+",") || strings.Contains(query, metric+")") {
+			return client.QueryResult{Timeseries: series}, nil
+		}
+	}
+	return client.QueryResult{}, nil
+}
+
+func containerSeries(namespace, pod, container string, value float64) client.Timeseries {
+	return client.Timeseries{
+		Tags: map[string]string{"namespace_name": namespace, "pod_name": pod, "container_name": container},
+		Data: [][]float64{{1600000000, 0}, {1600000060, value}},
+	}
+}
+
+func object(kind, namespace, name string, podLabels map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       kind,
+		"metadata":   map[string]interface{}{"namespace": namespace, "name": name, "labels": podLabels},
+	}}
+}
+
+func TestResourceMetrics(t *testing.T) {
+	waveClient := &seriesClient{series: map[string][]client.Timeseries{
+		"kubernetes.pod_container.cpu.usage_rate": {
+			containerSeries("default", "web-1", "web", 250),
+			containerSeries("default", "web-1", "sidecar", 0.5),
+			containerSeries("default", "web-2", "web", 100),
+			containerSeries("default", "deleted", "web", 100),
+			containerSeries("default", "web-3", "web", math.NaN()),
+		},
+		"kubernetes.pod_container.memory.working_set": {
+			containerSeries("default", "web-1", "web", 64*1024*1024),
+			containerSeries("default", "web-1", "sidecar", 1024*1024),
+			containerSeries("default", "web-2", "web", 32*1024*1024),
+			containerSeries("default", "deleted", "web", 1024),
+			containerSeries("default", "web-3", "web", 1024),
+		},
+		"kubernetes.node.cpu.usage_rate": {
+			{Tags: map[string]string{"nodename": "node-1"}, Data: [][]float64{{1600000060, 1500}}},
+		},
+		"kubernetes.node.memory.working_set": {
+			{Tags: map[string]string{"nodename": "node-1"}, Data: [][]float64{{1600000060, 4 * 1024 * 1024 * 1024}}},
+		},
+	}}
+	dynClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{podsResource: "PodList", nodesResource: "NodeList"},
+		object("Pod", "default", "web-1", map[string]interface{}{"app": "web"}),
+		object("Pod", "default", "web-2", map[string]interface{}{"app": "web"}),
+		object("Pod", "default", "web-3", map[string]interface{}{"app": "web"}),
+		object("Pod", "default", "db-1", map[string]interface{}{"app": "db"}),
+		object("Node", "", "node-1", nil))
+	p := &wavefrontProvider{dynClient: dynClient, waveClient: waveClient, prefix: "kubernetes"}
+
+	pods, err := p.ListPodMetrics("default", labels.SelectorFromSet(labels.Set{"app": "web"}))
+	assert.NoError(t, err)
+	// deleted pods and pods with invalid values are left out
+	assert.Len(t, pods, 2)
+	assert.Equal(t, "web-1", pods[0].Name)
+	assert.Equal(t, "default", pods[0].Namespace)
+	assert.Equal(t, int64(1600000060), pods[0].Timestamp.Unix())
+	assert.Len(t, pods[0].Containers, 2)
+	assert.Equal(t, "sidecar", pods[0].Containers[0].Name)
+	assert.Equal(t, "500u", pods[0].Containers[0].Usage.Cpu().String())
+	assert.Equal(t, "250m", pods[0].Containers[1].Usage.Cpu().String())
+	assert.Equal(t, "64Mi", pods[0].Containers[1].Usage.Memory().String())
+	assert.Equal(t, "web-2", pods[1].Name)
+	assert.Contains(t, waveClient.queries, `ts(kubernetes.pod_container.cpu.usage_rate, (namespace_name="default"))`)
+
+	pod, err := p.GetPodMetrics("default", "web-2")
+	assert.NoError(t, err)
+	assert.Equal(t, "100m", pod.Containers[0].Usage.Cpu().String())
+	assert.Contains(t, waveClient.queries, `ts(kubernetes.pod_container.memory.working_set, (pod_name="web-2") and (namespace_name="default"))`)
+
+	_, err = p.GetPodMetrics("default", "db-1")
+	assert.True(t, apierr.IsNotFound(err))
+
+	nodes, err := p.ListNodeMetrics(labels.Everything())
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, "1500m", nodes[0].Usage.Cpu().String())
+	assert.Equal(t, "4Gi", nodes[0].Usage.Memory().String())
+}
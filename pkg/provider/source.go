@@ -0,0 +1,81 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// defaultNamespaceTag is the tag holding the namespace of objects unless configured otherwise for a prefix
+const defaultNamespaceTag = "namespace_name"
+
+// CustomMetricSource is the Wavefront metric an exposed custom metric is sourced from.
+type CustomMetricSource struct {
+	Prefix config.MetricPrefix
+	// Metric is the name following the prefix and resource segment such as cpu.usage_rate
+	Metric string
+	// Conversion of the values served for the metric
+	Conversion config.Conversion
+}
+
+// query returns the ts query for the metric of the objects of the resource type with the given names.
+func (s CustomMetricSource) query(resType, namespace string, names ...string) string {
+	resourceFilter := filterFor(s.nameTag(resType), " or ", names...)
+	namespaceFilter := ""
+	if namespaced(resType) {
+		namespaceFilter = filterFor(s.namespaceTag(), "", namespace)
+	}
+	filters := combine(resourceFilter, namespaceFilter)
+	return fmt.Sprintf("ts(%s%s)", s.wavefrontName(resType), filters)
+}
+
+// wavefrontName returns the name of the metric in Wavefront such as kubernetes.pod.cpu.usage_rate or app.http.requests
+func (s CustomMetricSource) wavefrontName(resType string) string {
+	if s.Prefix.Resource != "" {
+		return fmt.Sprintf("%s.%s", s.Prefix.Prefix, s.Metric)
+	}
+	return fmt.Sprintf("%s.%s.%s", s.Prefix.Prefix, resType, s.Metric)
+}
+
+// nameTag returns the tag holding the names of objects of the resource type
+func (s CustomMetricSource) nameTag(resType string) string {
+	if s.Prefix.NameTag != "" {
+		return s.Prefix.NameTag
+	}
+	return tagKey(resType)
+}
+
+func (s CustomMetricSource) namespaceTag() string {
+	if s.Prefix.NamespaceTag != "" {
+		return s.Prefix.NamespaceTag
+	}
+	return defaultNamespaceTag
+}
+
+// splitPrefixed splits a metric name listed under the prefix into the resource type such as pod and the metric,
+// returning empty strings if the name is not of the form expected for the prefix.
+func splitPrefixed(prefix config.MetricPrefix, metricName string) (string, string) {
+	if prefix.Resource == "" {
+		return splitMetric(prefix.Prefix, metricName)
+	}
+	if !strings.HasPrefix(metricName, prefix.Prefix+".") {
+		return "", ""
+	}
+	return resourceType(prefix.Resource), metricName[len(prefix.Prefix)+1:]
+}
+
+// prefixFor returns the most specific of the prefixes the metric name is listed under, the first one on ties.
+func prefixFor(prefixes []config.MetricPrefix, metricName string) (config.MetricPrefix, bool) {
+	var match config.MetricPrefix
+	found := false
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(metricName, prefix.Prefix+".") && (!found || len(prefix.Prefix) > len(match.Prefix)) {
+			match, found = prefix, true
+		}
+	}
+	return match, found
+}
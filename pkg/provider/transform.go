@@ -0,0 +1,97 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// transform applies the transforms in order to the [timestamp, value] points of a series, timestamps being in seconds.
+// The given points are left unchanged.
+func transform(data [][]float64, transforms []config.Transform) ([][]float64, error) {
+	if len(transforms) == 0 {
+		return data, nil
+	}
+	for _, point := range data {
+		if len(point) != 2 {
+			return nil, fmt.Errorf("invalid data point: %v", point)
+		}
+	}
+	for _, t := range transforms {
+		switch t.Type {
+		case config.TransformRate:
+			data = rate(data)
+		case config.TransformEWMA:
+			data = ewma(data, time.Duration(t.HalfLife))
+		case config.TransformClamp:
+			data = clamp(data, t.Min, t.Max)
+		default:
+			return nil, fmt.Errorf("invalid transform %q", t.Type)
+		}
+	}
+	return data, nil
+}
+
+// rate returns the per-second rate between consecutive points of a monotonic counter, timestamped as the later point.
+// A decreasing value is a counter reset, whose increase is the value itself. Invalid values and points not later
+// than their predecessor are skipped, so n points result in at most n-1 rates.
+func rate(data [][]float64) [][]float64 {
+	result := make([][]float64, 0, len(data))
+	var previous []float64
+	for _, point := range data {
+		if !validValue(point[1]) || (previous != nil && point[0] <= previous[0]) {
+			continue
+		}
+		if previous != nil {
+			increase := point[1] - previous[1]
+			if increase < 0 {
+				increase = point[1]
+			}
+			result = append(result, []float64{point[0], increase / (point[0] - previous[0])})
+		}
+		previous = point
+	}
+	return result
+}
+
+// ewma returns the exponentially weighted moving average at every point, starting from the first valid value.
+// The weight of the previous average halves every halfLife, whatever the interval between points. Invalid values are skipped.
+func ewma(data [][]float64, halfLife time.Duration) [][]float64 {
+	result := make([][]float64, 0, len(data))
+	var average, last float64
+	for _, point := range data {
+		if !validValue(point[1]) {
+			continue
+		}
+		if len(result) == 0 {
+			average = point[1]
+		} else {
+			elapsed := math.Max(point[0]-last, 0)
+			average += (1 - math.Exp2(-elapsed/halfLife.Seconds())) * (point[1] - average)
+		}
+		last = point[0]
+		result = append(result, []float64{point[0], average})
+	}
+	return result
+}
+
+// clamp bounds every value to the range from min to max, either of which may be unbounded.
+func clamp(data [][]float64, min, max *float64) [][]float64 {
+	result := make([][]float64, len(data))
+	for i, point := range data {
+		value := point[1]
+		if min != nil && value < *min {
+			value = *min
+		}
+		if max != nil && value > *max {
+			value = *max
+		}
+		result[i] = []float64{point[0], value}
+	}
+	return result
+}
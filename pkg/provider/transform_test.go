@@ -0,0 +1,123 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
+)
+
+// counterData is a counter sampled every minute, reset to 0 between the 4th and 5th point
+var counterData = [][]float64{
+	{1600000000, 100},
+	{1600000060, 160},
+	{1600000120, 280},
+	{1600000180, 280},
+	{1600000240, 30},
+	{1600000300, 90},
+}
+
+func TestRate(t *testing.T) {
+	assert.Equal(t, [][]float64{
+		{1600000060, 1},
+		{1600000120, 2},
+		{1600000180, 0},
+		{1600000240, 0.5},
+		{1600000300, 1},
+	}, rate(counterData))
+
+	// invalid values and points out of order are skipped
+	assert.Equal(t, [][]float64{{1600000120, 1}}, rate([][]float64{
+		{1600000000, 100},
+		{1600000060, math.NaN()},
+		{1600000000, 50},
+		{1600000120, 220},
+	}))
+	assert.Empty(t, rate([][]float64{{1600000000, 100}}))
+	assert.Empty(t, rate(nil))
+}
+
+func TestEWMA(t *testing.T) {
+	data := [][]float64{
+		{1600000000, 0},
+		{1600000060, 100},
+		{1600000120, 100},
+		{1600000120, math.Inf(1)},
+		{1600000240, 0},
+	}
+	assert.Equal(t, [][]float64{
+		{1600000000, 0},
+		{1600000060, 50},
+		{1600000120, 75},
+		{1600000240, 18.75},
+	}, ewma(data, time.Minute))
+
+	// a longer half-life smooths spikes further
+	smoothed := ewma(data, 4*time.Minute)
+	assert.InDelta(t, 15.91, smoothed[1][1], 0.01)
+}
+
+func TestClamp(t *testing.T) {
+	min, max := 10.0, 50.0
+	data := [][]float64{{1600000000, 5}, {1600000060, 20}, {1600000120, 80}}
+	assert.Equal(t, [][]float64{{1600000000, 10}, {1600000060, 20}, {1600000120, 50}}, clamp(data, &min, &max))
+	assert.Equal(t, [][]float64{{1600000000, 5}, {1600000060, 20}, {1600000120, 50}}, clamp(data, nil, &max))
+	// the given points are left unchanged
+	assert.Equal(t, 5.0, data[0][1])
+}
+
+func TestTransforms(t *testing.T) {
+	max := 1.5
+	transforms := []config.Transform{
+		{Type: config.TransformRate},
+		{Type: config.TransformClamp, Max: &max},
+	}
+	data, err := transform(counterData, transforms)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]float64{
+		{1600000060, 1},
+		{1600000120, 1.5},
+		{1600000180, 0},
+		{1600000240, 0.5},
+		{1600000300, 1},
+	}, data)
+
+	_, err = transform([][]float64{{1600000000}}, transforms)
+	assert.EqualError(t, err, "invalid data point: [1.6e+09]")
+
+	// transforms run before the reduction, series without transformed points have no data
+	translator := NewWavefrontTranslator("kubernetes")
+	rule := config.MetricRule{Name: "requests_per_second", Reduction: config.ReductionAvg, Transforms: transforms}
+	values, err := translator.ExternalValuesFor(client.QueryResult{Timeseries: []client.Timeseries{{Data: counterData}}}, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, "800m", values.Items[0].Value.String())
+
+	_, err = translator.ExternalValuesFor(client.QueryResult{Timeseries: []client.Timeseries{{Data: counterData[:1]}}}, rule)
+	assert.EqualError(t, err, "no data for external metric: requests_per_second")
+}
+
+func TestValidateTransforms(t *testing.T) {
+	min, max := 5.0, 1.0
+	for transform, message := range map[*config.Transform]string{
+		{Type: "mavg"}:                                      `invalid transform "mavg" for rule: r`,
+		{Type: config.TransformEWMA}:                        "missing halfLife for transform ewma for rule: r",
+		{Type: config.TransformClamp}:                       "missing min or max for transform clamp for rule: r",
+		{Type: config.TransformClamp, Min: &min, Max: &max}: "min 5 exceeds max 1 for transform clamp for rule: r",
+	} {
+		rule := config.MetricRule{Name: "r", Query: "ts(a)", Transforms: []config.Transform{*transform}}
+		assert.EqualError(t, rule.Validate(), message)
+	}
+	rule := config.MetricRule{Name: "r", Query: "ts(a)", Transforms: []config.Transform{
+		{Type: config.TransformRate},
+		{Type: config.TransformEWMA, HalfLife: config.Duration(time.Minute)},
+		{Type: config.TransformClamp, Max: &max},
+	}}
+	assert.NoError(t, rule.Validate())
+}
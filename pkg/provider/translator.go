@@ -5,6 +5,7 @@ package provider
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -16,6 +17,7 @@ import (
 	"k8s.io/metrics/pkg/apis/external_metrics"
 
 	wave "github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
 )
 
@@ -24,7 +26,7 @@ type Translator interface {
 	MatchValuesToNames(queryResult wave.QueryResult, groupResource schema.GroupResource) (map[string]float64, bool)
 	CustomMetricsFor(metricNames []string) []provider.CustomMetricInfo
 	ExternalMetricsFor(metricNames []string) []provider.ExternalMetricInfo
-	ExternalValuesFor(queryResult wave.QueryResult, metric string) (*external_metrics.ExternalMetricValueList, error)
+	ExternalValuesFor(queryResult wave.QueryResult, rule config.MetricRule) (*external_metrics.ExternalMetricValueList, error)
 }
 
 type wavefrontTranslator struct {
@@ -37,31 +39,25 @@ func NewWavefrontTranslator(prefix string) Translator {
 
 // Translates given metric info into a Wavefront ts query
 func (t wavefrontTranslator) QueryFor(info provider.CustomMetricInfo, namespace string, names ...string) (string, bool) {
-	metric := info.Metric
-	resType := resourceType(info.GroupResource.Resource)
-	resourceFilter := filterFor(tagKey(resType), " or ", names...)
-	namespaceFilter := ""
-	if namespaced(resType) {
-		namespaceFilter = filterFor("namespace_name", "", namespace)
-	}
-	filters := combine(resourceFilter, namespaceFilter)
+	source := CustomMetricSource{Prefix: config.MetricPrefix{Prefix: t.prefix}, Metric: info.Metric}
 
 	// if Prefix=kubernetes, metric='cpu.usage_rate', resType='pod', namespace='default' and names=['pod1', 'pod2']
 	// ts(kubernetes.pod.cpu.usage_rate, (pod_name="pod1" or pod_name="pod2") and (namespace_name="default"))
-	query := fmt.Sprintf("ts(%s.%s.%s%s)", t.prefix, resType, metric, filters)
-	return query, true
+	return source.query(resourceType(info.GroupResource.Resource), namespace, names...), true
 }
 
 func (t wavefrontTranslator) MatchValuesToNames(queryResult wave.QueryResult, groupResource schema.GroupResource) (map[string]float64, bool) {
+	return matchValuesToNames(queryResult, tagKey(resourceType(groupResource.Resource)))
+}
+
+// matchValuesToNames maps the last value of every series to the value of its tag holding the object name
+func matchValuesToNames(queryResult wave.QueryResult, tagKey string) (map[string]float64, bool) {
 	log.Debugf("MatchValuesToNames: %v", queryResult.Timeseries)
 
 	if len(queryResult.Timeseries) == 0 {
 		return nil, false
 	}
 
-	resType := resourceType(groupResource.Resource)
-	tagKey := tagKey(resType)
-
 	values := make(map[string]float64, len(queryResult.Timeseries))
 	for _, timeseries := range queryResult.Timeseries {
 		length := len(timeseries.Data)
@@ -72,31 +68,54 @@ func (t wavefrontTranslator) MatchValuesToNames(queryResult wave.QueryResult, gr
 		if !found {
 			return nil, false
 		}
-		value, err := trimFloat(timeseries.Data[length-1][1])
-		if err != nil {
-			return nil, false
+		value := timeseries.Data[length-1][1]
+		if !validValue(value) {
+			log.Warningf("ignoring invalid value %v for %s=%s", value, tagKey, key)
+			continue
 		}
 		values[key] = value
 	}
 	return values, true
 }
 
+// invalidNames returns the names of the objects whose last value is NaN or infinite.
+func invalidNames(queryResult wave.QueryResult, tagKey string) map[string]bool {
+	invalid := make(map[string]bool)
+	for _, timeseries := range queryResult.Timeseries {
+		length := len(timeseries.Data)
+		if length == 0 {
+			continue
+		}
+		if key, found := timeseries.Tags[tagKey]; found && !validValue(timeseries.Data[length-1][1]) {
+			invalid[key] = true
+		}
+	}
+	return invalid
+}
+
 func (t wavefrontTranslator) CustomMetricsFor(metricNames []string) []provider.CustomMetricInfo {
 	var customMetrics []provider.CustomMetricInfo
 	for _, metricName := range metricNames {
-		resourceName, metric := splitMetric(t.prefix, metricName)
-		if resourceName == "" || metric == "" {
-			continue
+		if info, ok := customMetricFor(config.MetricPrefix{Prefix: t.prefix}, metricName); ok {
+			customMetrics = append(customMetrics, info)
 		}
-		customMetrics = append(customMetrics, provider.CustomMetricInfo{
-			GroupResource: schema.GroupResource{Group: "", Resource: normalize(resourceName)},
-			Metric:        metric,
-			Namespaced:    namespaced(resourceName),
-		})
 	}
 	return customMetrics
 }
 
+// customMetricFor returns the metric info for a metric name listed under the prefix
+func customMetricFor(prefix config.MetricPrefix, metricName string) (provider.CustomMetricInfo, bool) {
+	resourceName, metric := splitPrefixed(prefix, metricName)
+	if resourceName == "" || metric == "" {
+		return provider.CustomMetricInfo{}, false
+	}
+	return provider.CustomMetricInfo{
+		GroupResource: schema.GroupResource{Group: "", Resource: normalize(resourceName)},
+		Metric:        metric,
+		Namespaced:    namespaced(resourceName),
+	}, true
+}
+
 func (t wavefrontTranslator) ExternalMetricsFor(metricNames []string) []provider.ExternalMetricInfo {
 	var externalMetrics []provider.ExternalMetricInfo
 	for _, metricName := range metricNames {
@@ -107,36 +126,133 @@ func (t wavefrontTranslator) ExternalMetricsFor(metricNames []string) []provider
 	return externalMetrics
 }
 
-func (t wavefrontTranslator) ExternalValuesFor(queryResult wave.QueryResult, name string) (*external_metrics.ExternalMetricValueList, error) {
+func (t wavefrontTranslator) ExternalValuesFor(queryResult wave.QueryResult, rule config.MetricRule) (*external_metrics.ExternalMetricValueList, error) {
+	name := rule.Name
 	var matchingMetrics []external_metrics.ExternalMetricValue
 	for _, timeseries := range queryResult.Timeseries {
-		length := len(timeseries.Data)
-		if length == 0 {
+		data, err := transform(timeseries.Data, rule.Transforms)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data point for external metric: %s", name)
+		}
+		if len(data) == 0 {
+			if rule.Fallback != nil {
+				continue
+			}
 			return nil, fmt.Errorf("no data for external metric: %s", name)
 		}
 
-		// use the last data point
-		point := timeseries.Data[length-1]
-		if len(point) != 2 {
+		point, err := seriesValue(timeseries, data, rule)
+		if err != nil {
 			return nil, fmt.Errorf("invalid data point for external metric: %s", name)
 		}
-		value, err := trimFloat(point[1])
+		value, err := externalValue(name, point, rule.Conversion)
 		if err != nil {
-			log.Errorf("error converting external metric: %s value: %f", name, point[1])
+			log.Warningf("ignoring series of external metric %s: %v", name, err)
 			continue
 		}
-		metricValue := external_metrics.ExternalMetricValue{
-			MetricName: name,
-			Value:      *resource.NewMilliQuantity(int64(1000*value), resource.DecimalSI),
-			Timestamp:  metav1.Now(),
+		matchingMetrics = append(matchingMetrics, value)
+	}
+
+	if len(matchingMetrics) == 0 && rule.Fallback != nil {
+		log.Debugf("no data for external metric: %s, using fallback: %f", name, *rule.Fallback)
+		value, err := externalValue(name, *rule.Fallback, rule.Conversion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback for external metric %s: %v", name, err)
 		}
-		matchingMetrics = append(matchingMetrics, metricValue)
+		matchingMetrics = append(matchingMetrics, value)
 	}
 	return &external_metrics.ExternalMetricValueList{
 		Items: matchingMetrics,
 	}, nil
 }
 
+func externalValue(name string, value float64, conversion config.Conversion) (external_metrics.ExternalMetricValue, error) {
+	quantity, err := quantityFor(value, conversion)
+	if err != nil {
+		return external_metrics.ExternalMetricValue{}, err
+	}
+	return external_metrics.ExternalMetricValue{
+		MetricName: name,
+		Value:      quantity,
+		Timestamp:  metav1.Now(),
+	}, nil
+}
+
+// quantityFor returns the quantity served for the value, scaled and formatted as per the conversion.
+// Values are rounded to 3 decimals without any limit on their magnitude, smaller values keep 3 significant
+// digits down to the nano precision of quantities. NaN and infinite values are rejected.
+func quantityFor(value float64, conversion config.Conversion) (resource.Quantity, error) {
+	value = conversion.Apply(value)
+	if !validValue(value) {
+		return resource.Quantity{}, fmt.Errorf("invalid value: %v", value)
+	}
+
+	format := resource.DecimalSI
+	var s string
+	switch {
+	case conversion.Unit == config.UnitBytes:
+		// binary suffixes are only applied to quantities within the range of int64
+		if math.Abs(value) < math.MaxInt64 {
+			format = resource.BinarySI
+		}
+		s = strconv.FormatFloat(math.Round(value), 'f', 0, 64)
+	case conversion.Unit == config.UnitMillicores:
+		value = value / 1000
+		fallthrough
+	default:
+		if math.Abs(value) >= 0.001 || value == 0 {
+			s = strconv.FormatFloat(value, 'f', 3, 64)
+		} else {
+			s = strconv.FormatFloat(value, 'e', 2, 64)
+		}
+	}
+	parsed, err := resource.ParseQuantity(s)
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("invalid value %v: %v", value, err)
+	}
+	// the parsed quantity retains the string it was parsed from, rebuild it for the canonical format
+	return *resource.NewDecimalQuantity(*parsed.AsDec(), format), nil
+}
+
+// validValue returns false for NaN and infinite values, which are treated as missing data
+func validValue(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// reduce reduces the [timestamp, value] points of a series to a single value, using the last point by default.
+func reduce(data [][]float64, reduction string) (float64, error) {
+	var result float64
+	for i, point := range data {
+		if len(point) != 2 {
+			return 0, fmt.Errorf("invalid data point: %v", point)
+		}
+		value := point[1]
+		switch {
+		case i == 0, reduction == "", reduction == config.ReductionLast:
+			result = value
+		case reduction == config.ReductionAvg, reduction == config.ReductionSum:
+			result += value
+		case reduction == config.ReductionMin:
+			result = math.Min(result, value)
+		case reduction == config.ReductionMax:
+			result = math.Max(result, value)
+		}
+	}
+	if reduction == config.ReductionAvg {
+		result = result / float64(len(data))
+	}
+	return result, nil
+}
+
+// CustomMetricInfoFor returns the metric info for a resource such as "pods" and a metric such as "cpu.usage_rate".
+func CustomMetricInfoFor(resource, metric string) provider.CustomMetricInfo {
+	return provider.CustomMetricInfo{
+		GroupResource: schema.GroupResource{Group: "", Resource: resource},
+		Metric:        metric,
+		Namespaced:    namespaced(resourceType(resource)),
+	}
+}
+
 var (
 	resourceMap = map[string]string{
 		"cluster":       "clusters",
@@ -229,9 +345,3 @@ func splitMetric(prefix, metricName string) (string, string) {
 	}
 	return parts[0], parts[1]
 }
-
-// trims a float64 to 3 decimal digits
-func trimFloat(value float64) (float64, error) {
-	s := fmt.Sprintf("%.3f", value)
-	return strconv.ParseFloat(s, 3)
-}
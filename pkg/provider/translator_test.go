@@ -1,9 +1,12 @@
 package provider
 
 import (
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/client"
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/config"
 )
 
 func TestSplitMetric(t *testing.T) {
@@ -15,3 +18,95 @@ func TestSplitMetric(t *testing.T) {
 	assert.Equal(t, res, "pod")
 	assert.Equal(t, metric, "cpu.usage")
 }
+
+func TestReduce(t *testing.T) {
+	data := [][]float64{{1, 4}, {2, 1}, {3, 7}, {4, 2}}
+	for reduction, expected := range map[string]float64{
+		"":                   2,
+		config.ReductionLast: 2,
+		config.ReductionAvg:  3.5,
+		config.ReductionMin:  1,
+		config.ReductionMax:  7,
+		config.ReductionSum:  14,
+	} {
+		value, err := reduce(data, reduction)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value, reduction)
+	}
+
+	_, err := reduce([][]float64{{1}}, config.ReductionLast)
+	assert.Error(t, err)
+}
+
+func TestExternalValuesForFallback(t *testing.T) {
+	translator := NewWavefrontTranslator("kubernetes")
+	fallback := 5.0
+	rule := config.MetricRule{Name: "queue_depth", Query: "ts(queue.depth)", Fallback: &fallback}
+
+	values, err := translator.ExternalValuesFor(client.QueryResult{}, rule)
+	assert.NoError(t, err)
+	assert.Len(t, values.Items, 1)
+	assert.Equal(t, "5", values.Items[0].Value.String())
+
+	rule.Fallback = nil
+	values, err = translator.ExternalValuesFor(client.QueryResult{}, rule)
+	assert.NoError(t, err)
+	assert.Empty(t, values.Items)
+}
+
+func TestQuantityFor(t *testing.T) {
+	for _, test := range []struct {
+		value      float64
+		conversion config.Conversion
+		expected   string
+	}{
+		{0.25, config.Conversion{}, "250m"},
+		{524288000, config.Conversion{}, "524288k"},
+		{524288000, config.Conversion{Unit: config.UnitBytes}, "500Mi"},
+		{500, config.Conversion{Scale: 1024 * 1024, Unit: config.UnitBytes}, "500Mi"},
+		{250, config.Conversion{Unit: config.UnitMillicores}, "250m"},
+		{1500, config.Conversion{Unit: config.UnitMillicores}, "1500m"},
+		{2, config.Conversion{Scale: 0.5, Unit: config.UnitCores}, "1"},
+		{0, config.Conversion{}, "0"},
+		{-1.5, config.Conversion{}, "-1500m"},
+		{1.23456, config.Conversion{}, "1235m"},
+		// small values keep 3 significant digits
+		{0.000123456, config.Conversion{}, "123u"},
+		{0.0000015, config.Conversion{}, "1500n"},
+		{0.5, config.Conversion{Unit: config.UnitMillicores}, "500u"},
+		// values overflowing int64 once multiplied by 1000
+		{1e16, config.Conversion{}, "10P"},
+		{2.5e20, config.Conversion{}, "250E"},
+		{math.Pow(2, 62), config.Conversion{Unit: config.UnitBytes}, "4Ei"},
+		{math.Pow(2, 70), config.Conversion{Unit: config.UnitBytes}, "1180591620717411303424"},
+	} {
+		quantity, err := quantityFor(test.value, test.conversion)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, quantity.String(), "%v %+v", test.value, test.conversion)
+	}
+
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := quantityFor(value, config.Conversion{})
+		assert.Error(t, err)
+	}
+	_, err := quantityFor(math.MaxFloat64, config.Conversion{Scale: 10})
+	assert.Error(t, err)
+}
+
+func TestInvalidValuesAreMissing(t *testing.T) {
+	result := client.QueryResult{Timeseries: []client.Timeseries{
+		{Tags: map[string]string{"pod_name": "pod1"}, Data: [][]float64{{1, 2}}},
+		{Tags: map[string]string{"pod_name": "pod2"}, Data: [][]float64{{1, math.NaN()}}},
+		{Tags: map[string]string{"pod_name": "pod3"}, Data: [][]float64{{1, math.Inf(1)}}},
+	}}
+	values, found := matchValuesToNames(result, "pod_name")
+	assert.True(t, found)
+	assert.Equal(t, map[string]float64{"pod1": 2}, values)
+
+	fallback := 1.0
+	rule := config.MetricRule{Name: "queue_depth", Query: "ts(queue.depth)", Fallback: &fallback}
+	external, err := NewWavefrontTranslator("kubernetes").ExternalValuesFor(client.QueryResult{Timeseries: result.Timeseries[1:]}, rule)
+	assert.NoError(t, err)
+	assert.Len(t, external.Items, 1)
+	assert.Equal(t, "1", external.Items[0].Value.String())
+}
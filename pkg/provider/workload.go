@@ -0,0 +1,133 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// workloadResources are the kinds besides HPAs whose annotations can declare external metrics
+var workloadResources = map[string]schema.GroupVersionResource{
+	"Deployment":  {Group: "apps", Version: "v1", Resource: "deployments"},
+	"StatefulSet": {Group: "apps", Version: "v1", Resource: "statefulsets"},
+	"Rollout":     {Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+}
+
+// AnnotatedKinds returns the kinds whose annotations can declare external metrics.
+func AnnotatedKinds() []string {
+	kinds := []string{hpaSourceKind}
+	for kind := range workloadResources {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func validateAnnotatedKinds(kinds []string) error {
+	for _, kind := range kinds {
+		if _, found := workloadResources[kind]; !found && kind != hpaSourceKind {
+			return fmt.Errorf("unsupported kind %q, expected one of %v", kind, AnnotatedKinds())
+		}
+	}
+	return nil
+}
+
+// workloadServed returns whether the API server serves the resource of the kind,
+// Rollouts for instance are only served once Argo Rollouts is installed.
+func workloadServed(client discovery.DiscoveryInterface, kind string) (bool, error) {
+	resource := workloadResources[kind]
+	resources, err := client.ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if apierr.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type workloadListener struct {
+	client   metadata.Interface
+	kind     string
+	resource schema.GroupVersionResource
+	setFunc  RuleHandlerFunc
+	stopCh   <-chan struct{}
+}
+
+// StartWorkloadListener sources external metric rules from the annotations of every object of the given kind,
+// with the same semantics as HPA annotations, until stopCh is closed. Only the metadata of objects is cached.
+// The returned function reports whether every object has been listed.
+func StartWorkloadListener(client metadata.Interface, kind string, setFunc RuleHandlerFunc, stopCh <-chan struct{}) cache.InformerSynced {
+	listener := &workloadListener{
+		client:   client,
+		kind:     kind,
+		resource: workloadResources[kind],
+		setFunc:  setFunc,
+		stopCh:   stopCh,
+	}
+	return listener.listen()
+}
+
+func (l *workloadListener) listen() cache.InformerSynced {
+	log.Infof("listening for %s instances", l.kind)
+
+	inf := metadatainformer.NewFilteredMetadataInformer(l.client, l.resource, v1.NamespaceAll, 0, cache.Indexers{}, nil).Informer()
+
+	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			workload := obj.(*metav1.PartialObjectMetadata)
+			l.setFunc(l.source(workload), rulesFromAnnotations(workload.GetAnnotations()))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldWorkload := oldObj.(*metav1.PartialObjectMetadata)
+			newWorkload := newObj.(*metav1.PartialObjectMetadata)
+
+			// workloads are updated frequently when status changes
+			if reflect.DeepEqual(oldWorkload.GetAnnotations(), newWorkload.GetAnnotations()) {
+				return
+			}
+			l.setFunc(l.source(newWorkload), rulesFromAnnotations(newWorkload.GetAnnotations()))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			workload, ok := obj.(*metav1.PartialObjectMetadata)
+			if !ok {
+				log.Errorf("unexpected object deleted: %T", obj)
+				return
+			}
+			l.setFunc(l.source(workload), nil)
+		},
+	})
+	go inf.Run(l.stopCh)
+	return inf.HasSynced
+}
+
+func (l *workloadListener) source(obj *metav1.PartialObjectMetadata) ruleSource {
+	return ruleSource{
+		kind:      l.kind,
+		namespace: obj.GetNamespace(),
+		name:      obj.GetName(),
+		uid:       obj.GetUID(),
+	}
+}
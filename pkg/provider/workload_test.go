@@ -0,0 +1,84 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package provider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metadatafake "k8s.io/client-go/metadata/fake"
+)
+
+func TestWorkloadAnnotations(t *testing.T) {
+	deployment := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{"wavefront.com.external.metric/queue_depth": "ts(queue.depth)"},
+		},
+	}
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	client := metadatafake.NewSimpleMetadataClient(scheme, deployment)
+
+	driver := newWavefrontExternalDriver()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	StartWorkloadListener(client, "Deployment", driver.setRules, stopCh)
+
+	assert.Eventually(t, func() bool {
+		return queryOf(driver, "default", "queue_depth") == "ts(queue.depth)"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []ruleSource{{kind: "Deployment", namespace: "default", name: "app"}}, driver.getOwners("default", "queue_depth"))
+	assert.Equal(t, "apps/v1", driver.getOwners("default", "queue_depth")[0].objectRef().APIVersion)
+
+	// rules are scoped to the namespace of the workload
+	assert.Equal(t, "", queryOf(driver, "other", "queue_depth"))
+
+	err := client.Resource(workloadResources["Deployment"]).Namespace("default").Delete(context.Background(), "app", metav1.DeleteOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return queryOf(driver, "default", "queue_depth") == ""
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestValidateAnnotatedKinds(t *testing.T) {
+	assert.NoError(t, validateAnnotatedKinds([]string{"HorizontalPodAutoscaler", "Deployment", "StatefulSet", "Rollout"}))
+	assert.EqualError(t, validateAnnotatedKinds([]string{"DaemonSet"}),
+		`unsupported kind "DaemonSet", expected one of [Deployment HorizontalPodAutoscaler Rollout StatefulSet]`)
+}
+
+func TestWorkloadServed(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.Resources = []*metav1.APIResourceList{{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment"}},
+	}}
+
+	served, err := workloadServed(client.Discovery(), "Deployment")
+	assert.NoError(t, err)
+	assert.True(t, served)
+	served, err = workloadServed(client.Discovery(), "StatefulSet")
+	assert.NoError(t, err)
+	assert.False(t, served)
+	// the Rollout CRD is not installed, its informer would never sync
+	served, err = workloadServed(client.Discovery(), "Rollout")
+	assert.NoError(t, err)
+	assert.False(t, served)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	driver := NewExternalMetricsDriver(ExternalDriverConfig{
+		KubeClient:     client,
+		AnnotatedKinds: []string{"Rollout"},
+		StopCh:         stopCh,
+	})
+	assert.True(t, driver.hasSynced())
+}
@@ -0,0 +1,34 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package resourcemetrics serves the resource metrics API (metrics.k8s.io) used by kubectl top
+// and resource based HPAs in place of the metrics-server.
+package resourcemetrics
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/metrics/pkg/apis/metrics"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/provider"
+)
+
+// Install serves the PodMetrics and NodeMetrics of the provider as metrics.k8s.io/v1beta1 on the server.
+// The adapter server encodes responses with the scheme of the custom metrics API server, so the metrics.k8s.io
+// types must be installed into apiserver.Scheme first.
+func Install(server *genericapiserver.GenericAPIServer, provider provider.ResourceMetricsProvider) error {
+	if !apiserver.Scheme.IsGroupRegistered(metrics.GroupName) {
+		return fmt.Errorf("%s is not installed into the scheme of the server", metrics.GroupName)
+	}
+	info := genericapiserver.NewDefaultAPIGroupInfo(metrics.GroupName, apiserver.Scheme, metav1.ParameterCodec, apiserver.Codecs)
+	info.VersionedResourcesStorageMap[v1beta1.SchemeGroupVersion.Version] = map[string]rest.Storage{
+		"pods":  newPodMetrics(provider),
+		"nodes": newNodeMetrics(provider),
+	}
+	return server.InstallAPIGroup(&info)
+}
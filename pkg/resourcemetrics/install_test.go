@@ -0,0 +1,118 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package resourcemetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	apierr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/version"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/metrics"
+	"k8s.io/metrics/pkg/apis/metrics/install"
+	"k8s.io/metrics/pkg/apis/metrics/v1beta1"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/apiserver"
+)
+
+type fakeResourceProvider struct {
+	pods  []metrics.PodMetrics
+	nodes []metrics.NodeMetrics
+}
+
+func (p *fakeResourceProvider) GetPodMetrics(namespace, name string) (*metrics.PodMetrics, error) {
+	for i, pod := range p.pods {
+		if pod.Namespace == namespace && pod.Name == name {
+			return &p.pods[i], nil
+		}
+	}
+	return nil, apierr.NewNotFound(metrics.Resource("pods"), name)
+}
+
+func (p *fakeResourceProvider) ListPodMetrics(namespace string, selector labels.Selector) ([]metrics.PodMetrics, error) {
+	var pods []metrics.PodMetrics
+	for _, pod := range p.pods {
+		if namespace == "" || pod.Namespace == namespace {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+func (p *fakeResourceProvider) GetNodeMetrics(name string) (*metrics.NodeMetrics, error) {
+	return nil, apierr.NewNotFound(metrics.Resource("nodes"), name)
+}
+
+func (p *fakeResourceProvider) ListNodeMetrics(selector labels.Selector) ([]metrics.NodeMetrics, error) {
+	return p.nodes, nil
+}
+
+func usage(cpu, memory string) corev1.ResourceList {
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+}
+
+func TestInstall(t *testing.T) {
+	install.Install(apiserver.Scheme)
+	config := genericapiserver.NewConfig(apiserver.Codecs)
+	config.Version = &version.Info{Major: "1", Minor: "0"}
+	config.LoopbackClientConfig = &rest.Config{}
+	config.ExternalAddress = "localhost:6443"
+	server, err := config.Complete(nil).New("test", genericapiserver.NewEmptyDelegate())
+	assert.NoError(t, err)
+
+	assert.NoError(t, Install(server, &fakeResourceProvider{
+		pods: []metrics.PodMetrics{
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-1"},
+				Containers: []metrics.ContainerMetrics{{Name: "web", Usage: usage("250m", "64Mi")}}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-2"},
+				Containers: []metrics.ContainerMetrics{{Name: "web", Usage: usage("100m", "32Mi")}}},
+			{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "db-1"}},
+		},
+		nodes: []metrics.NodeMetrics{{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}, Usage: usage("2", "4Gi")}},
+	}))
+
+	// serve without authentication and authorization
+	handler := genericapifilters.WithRequestInfo(server.Handler.GoRestfulContainer, genericapiserver.NewRequestInfoResolver(config))
+	get := func(path string, into interface{}) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		if recorder.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), into))
+		}
+		return recorder.Code
+	}
+
+	var podList v1beta1.PodMetricsList
+	assert.Equal(t, http.StatusOK, get("/apis/metrics.k8s.io/v1beta1/namespaces/default/pods", &podList))
+	assert.Equal(t, "PodMetricsList", podList.Kind)
+	assert.Len(t, podList.Items, 2)
+
+	assert.Equal(t, http.StatusOK, get("/apis/metrics.k8s.io/v1beta1/pods?fieldSelector=metadata.name%3Ddb-1", &podList))
+	assert.Len(t, podList.Items, 1)
+	assert.Equal(t, "other", podList.Items[0].Namespace)
+
+	var pod v1beta1.PodMetrics
+	assert.Equal(t, http.StatusOK, get("/apis/metrics.k8s.io/v1beta1/namespaces/default/pods/web-1", &pod))
+	assert.Equal(t, "250m", pod.Containers[0].Usage.Cpu().String())
+	assert.Equal(t, "64Mi", pod.Containers[0].Usage.Memory().String())
+	assert.Equal(t, http.StatusNotFound, get("/apis/metrics.k8s.io/v1beta1/namespaces/other/pods/web-1", &pod))
+
+	var nodeList v1beta1.NodeMetricsList
+	assert.Equal(t, http.StatusOK, get("/apis/metrics.k8s.io/v1beta1/nodes", &nodeList))
+	assert.Len(t, nodeList.Items, 1)
+	assert.Equal(t, "2", nodeList.Items[0].Usage.Cpu().String())
+}
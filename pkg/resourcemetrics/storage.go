@@ -0,0 +1,155 @@
+// Copyright 2018-2020 VMware, Inc. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package resourcemetrics
+
+import (
+	"context"
+
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/metrics/pkg/apis/metrics"
+
+	"github.com/wavefronthq/wavefront-kubernetes-adapter/pkg/provider"
+)
+
+// podMetrics serves PodMetrics objects, which share the namespace and name of their pod
+type podMetrics struct {
+	provider provider.ResourceMetricsProvider
+	rest.TableConvertor
+}
+
+var _ rest.KindProvider = &podMetrics{}
+var _ rest.Storage = &podMetrics{}
+var _ rest.Getter = &podMetrics{}
+var _ rest.Lister = &podMetrics{}
+var _ rest.Scoper = &podMetrics{}
+
+func newPodMetrics(provider provider.ResourceMetricsProvider) *podMetrics {
+	return &podMetrics{
+		provider:       provider,
+		TableConvertor: rest.NewDefaultTableConvertor(metrics.Resource("pods")),
+	}
+}
+
+func (m *podMetrics) New() runtime.Object {
+	return &metrics.PodMetrics{}
+}
+
+func (m *podMetrics) Kind() string {
+	return "PodMetrics"
+}
+
+func (m *podMetrics) NamespaceScoped() bool {
+	return true
+}
+
+func (m *podMetrics) NewList() runtime.Object {
+	return &metrics.PodMetricsList{}
+}
+
+func (m *podMetrics) Get(ctx context.Context, name string, _ *metav1.GetOptions) (runtime.Object, error) {
+	pod, err := m.provider.GetPodMetrics(genericapirequest.NamespaceValue(ctx), name)
+	if err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+func (m *podMetrics) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	labelSelector, fieldSelector := selectors(options)
+	pods, err := m.provider.ListPodMetrics(genericapirequest.NamespaceValue(ctx), labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &metrics.PodMetricsList{Items: make([]metrics.PodMetrics, 0, len(pods))}
+	for _, pod := range pods {
+		if fieldSelector.Matches(objectFields(pod.ObjectMeta)) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+	return list, nil
+}
+
+// nodeMetrics serves NodeMetrics objects, which share the name of their node
+type nodeMetrics struct {
+	provider provider.ResourceMetricsProvider
+	rest.TableConvertor
+}
+
+var _ rest.KindProvider = &nodeMetrics{}
+var _ rest.Storage = &nodeMetrics{}
+var _ rest.Getter = &nodeMetrics{}
+var _ rest.Lister = &nodeMetrics{}
+var _ rest.Scoper = &nodeMetrics{}
+
+func newNodeMetrics(provider provider.ResourceMetricsProvider) *nodeMetrics {
+	return &nodeMetrics{
+		provider:       provider,
+		TableConvertor: rest.NewDefaultTableConvertor(metrics.Resource("nodes")),
+	}
+}
+
+func (m *nodeMetrics) New() runtime.Object {
+	return &metrics.NodeMetrics{}
+}
+
+func (m *nodeMetrics) Kind() string {
+	return "NodeMetrics"
+}
+
+func (m *nodeMetrics) NamespaceScoped() bool {
+	return false
+}
+
+func (m *nodeMetrics) NewList() runtime.Object {
+	return &metrics.NodeMetricsList{}
+}
+
+func (m *nodeMetrics) Get(_ context.Context, name string, _ *metav1.GetOptions) (runtime.Object, error) {
+	node, err := m.provider.GetNodeMetrics(name)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+func (m *nodeMetrics) List(_ context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	labelSelector, fieldSelector := selectors(options)
+	nodes, err := m.provider.ListNodeMetrics(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &metrics.NodeMetricsList{Items: make([]metrics.NodeMetrics, 0, len(nodes))}
+	for _, node := range nodes {
+		if fieldSelector.Matches(objectFields(node.ObjectMeta)) {
+			list.Items = append(list.Items, node)
+		}
+	}
+	return list, nil
+}
+
+// selectors returns the label and field selectors of the options, matching everything if not set
+func selectors(options *metainternalversion.ListOptions) (labels.Selector, fields.Selector) {
+	labelSelector, fieldSelector := labels.Everything(), fields.Everything()
+	if options != nil && options.LabelSelector != nil {
+		labelSelector = options.LabelSelector
+	}
+	if options != nil && options.FieldSelector != nil {
+		fieldSelector = options.FieldSelector
+	}
+	return labelSelector, fieldSelector
+}
+
+// objectFields returns the fields metrics can be selected by
+func objectFields(meta metav1.ObjectMeta) fields.Set {
+	return fields.Set{
+		"metadata.name":      meta.Name,
+		"metadata.namespace": meta.Namespace,
+	}
+}